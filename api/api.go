@@ -4,44 +4,50 @@ import (
 	"context"
 	"errors"
 	"go-stats/bot"
-	"go-stats/database"
+	"go-stats/events"
+	"go-stats/stats"
 	"os"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/meteran/gnext"
 	"github.com/meteran/gnext/docs"
-	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
 type Api struct {
 	ctx               context.Context
-	boltDb            *bolt.DB
 	apiID             int
 	apiHash           string
 	db                *gorm.DB
-	clickCh           chan *database.Event
+	sink              events.Sink
+	stats             *stats.Querier
 	log               *zap.Logger
 	botConnectionPool *bot.ConnectionPool
 }
 
 func NewApi(
 	ctx context.Context,
-	boltDb *bolt.DB,
 	apiID int,
 	apiHash string,
 	db *gorm.DB,
-	clickCh chan *database.Event,
+	sink events.Sink,
+	clickDb driver.Conn,
 	log *zap.Logger,
 	botConnectionPool *bot.ConnectionPool,
 ) Api {
+	var querier *stats.Querier
+	if clickDb != nil {
+		querier = stats.NewQuerier(clickDb)
+	}
+
 	return Api{
 		ctx:               ctx,
-		boltDb:            boltDb,
 		apiID:             apiID,
 		apiHash:           apiHash,
 		db:                db,
-		clickCh:           clickCh,
+		sink:              sink,
+		stats:             querier,
 		log:               log,
 		botConnectionPool: botConnectionPool,
 	}
@@ -49,22 +55,39 @@ func NewApi(
 
 func Start(
 	ctx context.Context,
-	boltDb *bolt.DB,
 	apiID int,
 	apiHash string,
 	db *gorm.DB,
-	clickCh chan *database.Event,
+	sink events.Sink,
+	clickDb driver.Conn,
 	log *zap.Logger,
 	botConnectionPool *bot.ConnectionPool,
 ) error {
 	r := gnext.Router(&docs.Options{Servers: []string{}})
 	apiLog := log.Named("api")
-	api := NewApi(ctx, boltDb, apiID, apiHash, db, clickCh, apiLog, botConnectionPool)
+	api := NewApi(ctx, apiID, apiHash, db, sink, clickDb, apiLog, botConnectionPool)
 
 	r.GET("/ping", api.ping)
 	r.GET("/add_bot", api.addBot)
 	r.GET("/get_bot", api.getBot)
+	r.GET("/bots", api.botStatuses)
+	r.GET("/bots/:id/status", api.botStatus)
+	r.POST("/stop_bot", api.stopBot)
+	r.POST("/restart_bot", api.restartBot)
+	r.POST("/logout_bot", api.logoutBot)
+	r.POST("/remove_bot", api.removeBot)
 	r.POST("/insert_users", api.insertUsers)
+	r.GET("/event_stats", api.eventStats)
+	r.GET("/event_schema", api.eventSchema)
+	r.POST("/events", api.pushEvents)
+	r.GET("/stats/active_users", api.activeUsers)
+	r.GET("/stats/new_users", api.newUsers)
+	r.GET("/stats/sessions", api.sessions)
+	r.GET("/stats/events", api.eventCounts)
+	r.GET("/stats/retention", api.retention)
+	r.POST("/funnels", api.addFunnel)
+	r.GET("/funnels", api.getFunnels)
+	r.GET("/stats/funnel", api.funnelReport)
 
 	host := os.Getenv("API_HOST")
 	if host == "" {
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"go-stats/database"
+	"go-stats/stats"
+	"net/http"
+	"time"
+
+	"github.com/meteran/gnext"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func funnelFromDb(f *database.Funnel) Funnel {
+	return Funnel{
+		ID:     f.ID,
+		BotID:  f.BotID,
+		Name:   f.Name,
+		Steps:  f.Steps,
+		Window: f.Window,
+	}
+}
+
+func (a *Api) addFunnel(q *FunnelBody) (*FunnelResponse, gnext.Status) {
+	if q.BotID == 0 || q.Name == "" {
+		return &FunnelResponse{Ok: false, Message: "bot_id and name are required"}, http.StatusBadRequest
+	}
+	if len(q.Steps) == 0 || len(q.Steps) > stats.MaxFunnelSteps {
+		return &FunnelResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Funnel must have between 1 and %d steps", stats.MaxFunnelSteps),
+		}, http.StatusBadRequest
+	}
+	for i, step := range q.Steps {
+		if step.EventType == "" {
+			return &FunnelResponse{
+				Ok:      false,
+				Message: fmt.Sprintf("Step %d has no event_type", i+1),
+			}, http.StatusBadRequest
+		}
+	}
+
+	funnel := database.Funnel{
+		BotID:  q.BotID,
+		Name:   q.Name,
+		Steps:  q.Steps,
+		Window: q.Window,
+	}
+	if funnel.Window <= 0 {
+		funnel.Window = int64(24 * time.Hour / time.Second)
+	}
+	if err := a.db.Create(&funnel).Error; err != nil {
+		a.log.Info("Error adding funnel to database", zap.Error(err))
+		return &FunnelResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Error adding funnel to database: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	return &FunnelResponse{Ok: true, Funnel: funnelFromDb(&funnel)}, http.StatusOK
+}
+
+func (a *Api) getFunnels(q *FunnelsQuery) (*FunnelsResponse, gnext.Status) {
+	var dbFunnels []database.Funnel
+	if err := a.db.Where(&database.Funnel{BotID: q.BotID}).Order("id").Find(&dbFunnels).Error; err != nil {
+		return &FunnelsResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Could not get funnels: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	funnels := make([]Funnel, 0, len(dbFunnels))
+	for i := range dbFunnels {
+		funnels = append(funnels, funnelFromDb(&dbFunnels[i]))
+	}
+	return &FunnelsResponse{Ok: true, Funnels: funnels}, http.StatusOK
+}
+
+func (a *Api) funnelReport(q *FunnelReportQuery) (*FunnelReportResponse, gnext.Status) {
+	if a.stats == nil {
+		return &FunnelReportResponse{
+			Ok:      false,
+			Message: "Statistics require CLICKHOUSE_DSN",
+		}, http.StatusServiceUnavailable
+	}
+
+	if q.FunnelID == 0 {
+		return &FunnelReportResponse{Ok: false, Message: "funnel_id is required"}, http.StatusBadRequest
+	}
+	funnel := database.Funnel{ID: q.FunnelID}
+	if err := a.db.First(&funnel).Error; err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		return &FunnelReportResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Could not get funnel: %s", err),
+		}, gnext.Status(status)
+	}
+
+	from, to, err := dateRange(q.From, q.To)
+	if err != nil {
+		return &FunnelReportResponse{Ok: false, Message: err.Error()}, http.StatusBadRequest
+	}
+
+	steps, err := a.stats.Funnel(a.ctx, stats.FunnelFilter{
+		BotID:  funnel.BotID,
+		Steps:  funnel.Steps,
+		Window: time.Duration(funnel.Window) * time.Second,
+		From:   from,
+		To:     to,
+	})
+	if err != nil {
+		a.log.Info("Error querying funnel", zap.Error(err))
+		return &FunnelReportResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Error querying funnel: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	return &FunnelReportResponse{Ok: true, Steps: steps}, http.StatusOK
+}
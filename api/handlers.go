@@ -3,9 +3,11 @@ package api
 import (
 	"fmt"
 	"go-stats/bot"
+	"go-stats/events"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/meteran/gnext"
@@ -43,8 +45,21 @@ func (a *Api) addBot(q *Bot) (*Response, gnext.Status) {
 		}, http.StatusBadRequest
 	}
 
+	// A running bot is kept unless its session is replaced,
+	// then it must not use the session while the bot logs in again
+	alreadyRunning := false
+	if status, err := a.botConnectionPool.BotStatus(botIdInt); err == nil {
+		if q.ForceAuth {
+			if err := a.botConnectionPool.StopBot(botIdInt); err != nil {
+				a.log.Info("Error stopping bot", zap.Error(err))
+			}
+		} else {
+			alreadyRunning = status.State == bot.StateRunning
+		}
+	}
+
 	// Login bot
-	if err := bot.LoginBot(a.ctx, a.boltDb, a.apiID, a.apiHash, q.Token, a.log, q.ForceAuth); err != nil {
+	if err := bot.LoginBot(a.ctx, a.botConnectionPool.SessionStorage(botIdInt), a.apiID, a.apiHash, q.Token, a.log, q.ForceAuth); err != nil {
 		a.log.Info("Error logging in bot", zap.Error(err))
 		return &Response{
 			Ok:      false,
@@ -66,8 +81,12 @@ func (a *Api) addBot(q *Bot) (*Response, gnext.Status) {
 		}, http.StatusBadRequest
 	}
 
-	// Start bot
-	if err := a.botConnectionPool.AddBot(botIdInt); err != nil {
+	if alreadyRunning {
+		return &Response{Ok: true}, http.StatusOK
+	}
+
+	// Start bot, a bot already in the pool is replaced
+	if err := a.botConnectionPool.StartBot(botIdInt, true); err != nil {
 		a.log.Info("Error starting bot", zap.Error(err))
 		return &Response{
 			Ok:      false,
@@ -75,11 +94,166 @@ func (a *Api) addBot(q *Bot) (*Response, gnext.Status) {
 		}, http.StatusBadRequest
 	}
 
-	go a.botConnectionPool.RunBot(botIdInt, true)
+	return &Response{Ok: true}, http.StatusOK
+}
+
+func (a *Api) botStatus(id int) (*BotStatusResponse, gnext.Status) {
+	status, err := a.botConnectionPool.BotStatus(int64(id))
+	if err != nil {
+		return &BotStatusResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Could not get status: %s", err),
+		}, http.StatusNotFound
+	}
+	return &BotStatusResponse{Ok: true, Status: status}, http.StatusOK
+}
+
+func (a *Api) botStatuses() (*BotStatusesResponse, gnext.Status) {
+	return &BotStatusesResponse{Ok: true, Bots: a.botConnectionPool.BotStatuses()}, http.StatusOK
+}
+
+func (a *Api) stopBot(q *BotActionBody) (*Response, gnext.Status) {
+	if err := a.botConnectionPool.StopBot(q.BotID); err != nil {
+		return &Response{
+			Ok:      false,
+			Message: fmt.Sprintf("Error stopping bot: %s", err),
+		}, http.StatusBadRequest
+	}
+	return &Response{Ok: true}, http.StatusOK
+}
+
+func (a *Api) restartBot(q *BotActionBody) (*Response, gnext.Status) {
+	if err := a.botConnectionPool.RestartBot(q.BotID); err != nil {
+		a.log.Info("Error restarting bot", zap.Error(err))
+		return &Response{
+			Ok:      false,
+			Message: fmt.Sprintf("Error restarting bot: %s", err),
+		}, http.StatusBadRequest
+	}
+	return &Response{Ok: true}, http.StatusOK
+}
 
+func (a *Api) logoutBot(q *BotActionBody) (*Response, gnext.Status) {
+	if err := a.botConnectionPool.LogoutBot(a.ctx, q.BotID); err != nil {
+		a.log.Info("Error logging out bot", zap.Error(err))
+		return &Response{
+			Ok:      false,
+			Message: fmt.Sprintf("Error logging out bot: %s", err),
+		}, http.StatusBadRequest
+	}
 	return &Response{Ok: true}, http.StatusOK
 }
 
-func (a *Api) insertUsers(q *InsertUsersQuery) (*Response, gnext.Status) {
+func (a *Api) removeBot(q *BotActionBody) (*Response, gnext.Status) {
+	if err := a.botConnectionPool.RemoveBot(q.BotID); err != nil {
+		return &Response{
+			Ok:      false,
+			Message: fmt.Sprintf("Error removing bot: %s", err),
+		}, http.StatusBadRequest
+	}
 	return &Response{Ok: true}, http.StatusOK
 }
+
+func (a *Api) insertUsers(q *InsertUsersQuery) (*InsertUsersResponse, gnext.Status) {
+	if _, err := bot.GetFromDb(a.db, nil, q.BotID); err != nil {
+		return &InsertUsersResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Could not get info: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	userIDs := make([]int64, 0, len(q.Users))
+	for _, userID := range q.Users {
+		userIDs = append(userIDs, int64(userID))
+	}
+
+	inserted, err := a.botConnectionPool.ImportUsers(q.BotID, userIDs, q.Referer)
+	if err != nil {
+		a.log.Info("Error importing users", zap.Error(err))
+		return &InsertUsersResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Error importing users: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	if q.ForceCheck {
+		if _, err := a.botConnectionPool.GetApi(q.BotID); err != nil {
+			return &InsertUsersResponse{
+				Ok:       false,
+				Message:  fmt.Sprintf("Users imported, but could not check them: %s", err),
+				Inserted: inserted,
+			}, http.StatusBadRequest
+		}
+
+		// Probing is paced by FLOOD_WAIT and can take long
+		go func() {
+			result, err := a.botConnectionPool.CheckUsers(a.ctx, q.BotID, userIDs)
+			if err != nil {
+				a.log.Error("Error checking users",
+					zap.Int64("bot", q.BotID),
+					zap.Int("probed", result.Probed()),
+					zap.Int("total", len(userIDs)),
+					zap.Error(err),
+				)
+				return
+			}
+			a.log.Info("Users checked",
+				zap.Int64("bot", q.BotID),
+				zap.Int("reachable", result.Reachable),
+				zap.Int("blocked", result.Blocked),
+				zap.Int("unknown", result.Unknown),
+			)
+		}()
+	}
+
+	return &InsertUsersResponse{Ok: true, Inserted: inserted}, http.StatusOK
+}
+
+func (a *Api) pushEvents(q *CustomEventsBody) (*Response, gnext.Status) {
+	if a.ctx.Err() != nil {
+		return &Response{Ok: false, Message: "Shutting down"}, http.StatusServiceUnavailable
+	}
+
+	customEvents := make([]bot.CustomEvent, 0, len(q.Events))
+	for _, e := range q.Events {
+		custom := bot.CustomEvent{
+			ID:        e.ID,
+			Name:      e.Name,
+			UserID:    e.UserID,
+			ChatID:    e.ChatID,
+			ContentID: e.ContentID,
+			Language:  e.Language,
+			Fields:    e.Fields,
+		}
+		if e.Timestamp != 0 {
+			custom.Timestamp = time.Unix(e.Timestamp, 0)
+		}
+		customEvents = append(customEvents, custom)
+	}
+
+	if err := a.botConnectionPool.PushCustomEvents(a.ctx, q.BotID, customEvents); err != nil {
+		a.log.Info("Error pushing custom events", zap.Error(err))
+		return &Response{
+			Ok:      false,
+			Message: fmt.Sprintf("Error pushing events: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	return &Response{Ok: true}, http.StatusOK
+}
+
+func (a *Api) eventStats() (*EventStatsResponse, gnext.Status) {
+	counter, ok := a.sink.(events.Counter)
+	if !ok {
+		return &EventStatsResponse{
+			Ok:      false,
+			Message: "Event sink does not count events",
+		}, http.StatusNotFound
+	}
+
+	return &EventStatsResponse{Ok: true, Stats: counter.Stats()}, http.StatusOK
+}
+
+func (a *Api) eventSchema() (*EventSchemaResponse, gnext.Status) {
+	return &EventSchemaResponse{Ok: true, Schemas: bot.EventSchemas()}, http.StatusOK
+}
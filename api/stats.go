@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"go-stats/stats"
+	"net/http"
+	"time"
+
+	"github.com/meteran/gnext"
+	"go.uber.org/zap"
+)
+
+const dateLayout = "2006-01-02"
+
+// dateRange parses an inclusive date range into [from, to).
+// By default the last 30 days are selected.
+func dateRange(fromDate, toDate string) (from, to time.Time, err error) {
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	if toDate != "" {
+		if to, err = time.Parse(dateLayout, toDate); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	from = to.AddDate(0, 0, -30)
+	if fromDate != "" {
+		if from, err = time.Parse(dateLayout, fromDate); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+func (q *StatsQuery) filter() (stats.Filter, error) {
+	from, to, err := dateRange(q.From, q.To)
+	return stats.Filter{
+		BotID:     q.BotID,
+		App:       q.App,
+		From:      from,
+		To:        to,
+		Period:    stats.Period(q.Period),
+		Breakdown: stats.Breakdown(q.Breakdown),
+	}, err
+}
+
+func (a *Api) statsSeries(
+	q *StatsQuery,
+	series func(context.Context, stats.Filter) ([]stats.Row, error),
+) (*StatsResponse, gnext.Status) {
+	if a.stats == nil {
+		return &StatsResponse{
+			Ok:      false,
+			Message: "Statistics require CLICKHOUSE_DSN",
+		}, http.StatusServiceUnavailable
+	}
+
+	f, err := q.filter()
+	if err != nil {
+		return &StatsResponse{Ok: false, Message: err.Error()}, http.StatusBadRequest
+	}
+
+	rows, err := series(a.ctx, f)
+	if err != nil {
+		a.log.Info("Error querying stats", zap.Error(err))
+		return &StatsResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Error querying stats: %s", err),
+		}, http.StatusBadRequest
+	}
+	if rows == nil {
+		rows = []stats.Row{}
+	}
+
+	return &StatsResponse{Ok: true, Rows: rows}, http.StatusOK
+}
+
+func (a *Api) activeUsers(q *StatsQuery) (*StatsResponse, gnext.Status) {
+	return a.statsSeries(q, a.stats.ActiveUsers)
+}
+
+func (a *Api) newUsers(q *StatsQuery) (*StatsResponse, gnext.Status) {
+	return a.statsSeries(q, a.stats.NewUsers)
+}
+
+func (a *Api) sessions(q *StatsQuery) (*StatsResponse, gnext.Status) {
+	return a.statsSeries(q, a.stats.Sessions)
+}
+
+func (a *Api) eventCounts(q *StatsQuery) (*StatsResponse, gnext.Status) {
+	return a.statsSeries(q, a.stats.Events)
+}
+
+func (a *Api) retention(q *RetentionQuery) (*RetentionResponse, gnext.Status) {
+	if a.stats == nil {
+		return &RetentionResponse{
+			Ok:      false,
+			Message: "Statistics require CLICKHOUSE_DSN",
+		}, http.StatusServiceUnavailable
+	}
+
+	from, to, err := dateRange(q.From, q.To)
+	if err != nil {
+		return &RetentionResponse{Ok: false, Message: err.Error()}, http.StatusBadRequest
+	}
+	periods := q.Periods
+	if periods == 0 {
+		periods = 8
+	}
+
+	cohorts, err := a.stats.Retention(a.ctx, stats.RetentionFilter{
+		BotID:     q.BotID,
+		From:      from,
+		To:        to,
+		Period:    stats.Period(q.Period),
+		Periods:   periods,
+		ByReferer: q.ByReferer,
+	})
+	if err != nil {
+		a.log.Info("Error querying retention", zap.Error(err))
+		return &RetentionResponse{
+			Ok:      false,
+			Message: fmt.Sprintf("Error querying retention: %s", err),
+		}, http.StatusBadRequest
+	}
+
+	return &RetentionResponse{Ok: true, Cohorts: cohorts}, http.StatusOK
+}
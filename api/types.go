@@ -1,6 +1,13 @@
 package api
 
-import "github.com/meteran/gnext"
+import (
+	"go-stats/bot"
+	"go-stats/database"
+	"go-stats/events"
+	"go-stats/stats"
+
+	"github.com/meteran/gnext"
+)
 
 type Response struct {
 	Ok      bool   `json:"ok"`
@@ -14,6 +21,30 @@ type BotResponse struct {
 	LoggedIn bool   `json:"logged_in"`
 }
 
+type BotStatusResponse struct {
+	Ok      bool          `json:"ok"`
+	Message string        `json:"message"`
+	Status  bot.BotStatus `json:"status"`
+}
+
+type BotStatusesResponse struct {
+	Ok      bool            `json:"ok"`
+	Message string          `json:"message"`
+	Bots    []bot.BotStatus `json:"bots"`
+}
+
+type EventStatsResponse struct {
+	Ok      bool         `json:"ok"`
+	Message string       `json:"message"`
+	Stats   events.Stats `json:"stats"`
+}
+
+type EventSchemaResponse struct {
+	Ok      bool                        `json:"ok"`
+	Message string                      `json:"message"`
+	Schemas map[string][]bot.EventField `json:"schemas"`
+}
+
 type Bot struct {
 	gnext.Query
 	Source    string `form:"source"`
@@ -28,9 +59,116 @@ type GetBotQuery struct {
 	Source string `form:"source"`
 }
 
+type BotActionBody struct {
+	gnext.Body
+	BotID int64 `json:"bot_id"`
+}
+
 type InsertUsersQuery struct {
 	gnext.Body
-	BotID      int64 `json:"bot_id"`
-	ForceCheck bool  `json:"force_check"`
-	Users      []int `json:"user_ids"`
+	BotID      int64  `json:"bot_id"`
+	ForceCheck bool   `json:"force_check"`
+	Users      []int  `json:"user_ids"`
+	Referer    string `json:"referer"`
+}
+
+type InsertUsersResponse struct {
+	Ok       bool   `json:"ok"`
+	Message  string `json:"message"`
+	Inserted int64  `json:"inserted"`
+}
+
+type CustomEvent struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	UserID    int64             `json:"user_id"`
+	ChatID    int64             `json:"chat_id"`
+	ContentID string            `json:"content_id"`
+	Language  string            `json:"language"`
+	Fields    map[string]string `json:"fields"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+type CustomEventsBody struct {
+	gnext.Body
+	BotID  int64         `json:"bot_id"`
+	Events []CustomEvent `json:"events"`
+}
+
+type StatsQuery struct {
+	gnext.Query
+	BotID     int64  `form:"bot_id"`
+	App       string `form:"app"`
+	From      string `form:"from"`
+	To        string `form:"to"`
+	Period    string `form:"period"`
+	Breakdown string `form:"breakdown"`
+}
+
+type StatsResponse struct {
+	Ok      bool        `json:"ok"`
+	Message string      `json:"message"`
+	Rows    []stats.Row `json:"rows"`
+}
+
+type RetentionQuery struct {
+	gnext.Query
+	BotID     int64  `form:"bot_id"`
+	From      string `form:"from"`
+	To        string `form:"to"`
+	Period    string `form:"period"`
+	Periods   int    `form:"periods"`
+	ByReferer bool   `form:"by_referer"`
+}
+
+type RetentionResponse struct {
+	Ok      bool           `json:"ok"`
+	Message string         `json:"message"`
+	Cohorts []stats.Cohort `json:"cohorts"`
+}
+
+type FunnelBody struct {
+	gnext.Body
+	BotID  int64                 `json:"bot_id"`
+	Name   string                `json:"name"`
+	Steps  []database.FunnelStep `json:"steps"`
+	Window int64                 `json:"window"`
+}
+
+type FunnelsQuery struct {
+	gnext.Query
+	BotID int64 `form:"bot_id"`
+}
+
+type Funnel struct {
+	ID     int64                 `json:"id"`
+	BotID  int64                 `json:"bot_id"`
+	Name   string                `json:"name"`
+	Steps  []database.FunnelStep `json:"steps"`
+	Window int64                 `json:"window"`
+}
+
+type FunnelResponse struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message"`
+	Funnel  Funnel `json:"funnel"`
+}
+
+type FunnelsResponse struct {
+	Ok      bool     `json:"ok"`
+	Message string   `json:"message"`
+	Funnels []Funnel `json:"funnels"`
+}
+
+type FunnelReportQuery struct {
+	gnext.Query
+	FunnelID int64  `form:"funnel_id"`
+	From     string `form:"from"`
+	To       string `form:"to"`
+}
+
+type FunnelReportResponse struct {
+	Ok      bool                     `json:"ok"`
+	Message string                   `json:"message"`
+	Steps   []stats.FunnelStepResult `json:"steps"`
 }
@@ -3,8 +3,6 @@ package bot
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
-	"sync"
 
 	bolt "go.etcd.io/bbolt"
 
@@ -12,6 +10,7 @@ import (
 
 	"github.com/gotd/contrib/bbolt"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 func i2b(v int) []byte { b := make([]byte, 8); binary.LittleEndian.PutUint64(b, uint64(v)); return b }
@@ -26,52 +25,62 @@ func i642b(v int64) []byte {
 
 func b2i64(b []byte) int64 { return int64(binary.LittleEndian.Uint64(b)) }
 
-var _ updates.StateStorage = (*BoltState)(nil)
+var (
+	_ updates.StateStorage = (*BoltState)(nil)
+	_ updates.BatchStorage = (*BoltState)(nil)
+)
+
+// Every bot has a bucket keyed by its ID with the update state,
+// channel pts, channel access hashes and the session.
+var (
+	stateBucket    = []byte("state")
+	channelsBucket = []byte("channels")
+)
+
+// ErrStateNotFound is returned when a part of the state is updated
+// before the state is set.
+var ErrStateNotFound = errors.New("state not found")
 
+// BoltState keeps the update state of the bots in bbolt.
 type BoltState struct {
-	db       *bolt.DB
-	channels map[int64]map[int64]int
-	mux      sync.Mutex
+	db *bolt.DB
 }
 
 func NewBoltState(db *bolt.DB) *BoltState {
-	return &BoltState{db: db, channels: map[int64]map[int64]int{}}
+	return &BoltState{db: db}
 }
 
 func (s *BoltState) GetState(ctx context.Context, userID int64) (state updates.State, found bool, err error) {
-	tx, err := s.db.Begin(false)
-	if err != nil {
-		return updates.State{}, false, err
-	}
-	defer func() { _ = tx.Rollback() }()
-
-	user := tx.Bucket(i642b(userID))
-	if user == nil {
-		return updates.State{}, false, nil
-	}
-
-	stateBucket := user.Bucket([]byte("state"))
-	if stateBucket == nil {
-		return updates.State{}, false, nil
-	}
-
-	var (
-		pts  = stateBucket.Get([]byte("pts"))
-		qts  = stateBucket.Get([]byte("qts"))
-		date = stateBucket.Get([]byte("date"))
-		seq  = stateBucket.Get([]byte("seq"))
-	)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(userID))
+		if user == nil {
+			return nil
+		}
+		b := user.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
 
-	if pts == nil || qts == nil || date == nil || seq == nil {
-		return updates.State{}, false, nil
-	}
+		var (
+			pts  = b.Get([]byte("pts"))
+			qts  = b.Get([]byte("qts"))
+			date = b.Get([]byte("date"))
+			seq  = b.Get([]byte("seq"))
+		)
+		if pts == nil || qts == nil || date == nil || seq == nil {
+			return nil
+		}
 
-	return updates.State{
-		Pts:  b2i(pts),
-		Qts:  b2i(qts),
-		Date: b2i(date),
-		Seq:  b2i(seq),
-	}, true, nil
+		state = updates.State{
+			Pts:  b2i(pts),
+			Qts:  b2i(qts),
+			Date: b2i(date),
+			Seq:  b2i(seq),
+		}
+		found = true
+		return nil
+	})
+	return state, found, err
 }
 
 func (s *BoltState) SetState(ctx context.Context, userID int64, state updates.State) error {
@@ -81,181 +90,89 @@ func (s *BoltState) SetState(ctx context.Context, userID int64, state updates.St
 			return err
 		}
 
-		b, err := user.CreateBucketIfNotExists([]byte("state"))
+		b, err := user.CreateBucketIfNotExists(stateBucket)
 		if err != nil {
 			return err
 		}
 
-		check := func(e error) {
-			if err != nil {
-				return
-			}
-			err = e
-		}
-
-		check(b.Put([]byte("pts"), i2b(state.Pts)))
-		check(b.Put([]byte("qts"), i2b(state.Qts)))
-		check(b.Put([]byte("date"), i2b(state.Date)))
-		check(b.Put([]byte("seq"), i2b(state.Seq)))
-		return err
+		return putInts(b, "pts", state.Pts, "qts", state.Qts, "date", state.Date, "seq", state.Seq)
 	})
 }
 
 func (s *BoltState) SetPts(ctx context.Context, userID int64, pts int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
-			return err
-		}
-
-		state := user.Bucket([]byte("state"))
-		if state == nil {
-			return fmt.Errorf("internalState not found")
-		}
-		return state.Put([]byte("pts"), i2b(pts))
-	})
+	return s.updateState(userID, "pts", pts)
 }
 
 func (s *BoltState) SetQts(ctx context.Context, userID int64, qts int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
-			return err
-		}
-
-		state := user.Bucket([]byte("state"))
-		if state == nil {
-			return fmt.Errorf("internalState not found")
-		}
-		return state.Put([]byte("qts"), i2b(qts))
-	})
+	return s.updateState(userID, "qts", qts)
 }
 
 func (s *BoltState) SetDate(ctx context.Context, userID int64, date int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
-			return err
-		}
-
-		state := user.Bucket([]byte("state"))
-		if state == nil {
-			return fmt.Errorf("internalState not found")
-		}
-		return state.Put([]byte("date"), i2b(date))
-	})
+	return s.updateState(userID, "date", date)
 }
 
 func (s *BoltState) SetSeq(ctx context.Context, userID int64, seq int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
-			return err
-		}
-
-		state := user.Bucket([]byte("state"))
-		if state == nil {
-			return fmt.Errorf("internalState not found")
-		}
-		return state.Put([]byte("seq"), i2b(seq))
-	})
+	return s.updateState(userID, "seq", seq)
 }
 
 func (s *BoltState) SetDateSeq(ctx context.Context, userID int64, date, seq int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
-			return err
-		}
+	return s.updateState(userID, "date", date, "seq", seq)
+}
 
-		state := user.Bucket([]byte("state"))
-		if state == nil {
-			return fmt.Errorf("internalState not found")
+// updateState sets the key value pairs of the existing state.
+func (s *BoltState) updateState(userID int64, kv ...any) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(userID))
+		if user == nil {
+			return ErrStateNotFound
 		}
-		if err := state.Put([]byte("date"), i2b(date)); err != nil {
-			return err
+		b := user.Bucket(stateBucket)
+		if b == nil {
+			return ErrStateNotFound
 		}
-		return state.Put([]byte("seq"), i2b(seq))
+		return putInts(b, kv...)
 	})
 }
 
-func (s *BoltState) GetChannelPtsM(ctx context.Context, userID, channelID int64) (pts int, found bool, err error) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	channels, ok := s.channels[userID]
-	if !ok {
-		return 0, false, nil
-	}
-
-	pts, found = channels[channelID]
-	return
-}
-
-func (s *BoltState) SetChannelPtsM(ctx context.Context, userID, channelID int64, pts int) error {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	channels, ok := s.channels[userID]
-	if !ok {
-		return errors.New("user internalState does not exist")
-	}
-
-	channels[channelID] = pts
-	return nil
-}
-
-func (s *BoltState) ForEachChannelsM(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	cmap, ok := s.channels[userID]
-	if !ok {
-		return nil
-	}
-
-	for id, pts := range cmap {
-		if err := f(ctx, id, pts); err != nil {
+// putInts puts the key value pairs, kv alternates string keys and int values.
+func putInts(b *bolt.Bucket, kv ...any) error {
+	for i := 0; i < len(kv); i += 2 {
+		if err := b.Put([]byte(kv[i].(string)), i2b(kv[i+1].(int))); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (s *BoltState) GetChannelPts(ctx context.Context, userID, channelID int64) (int, bool, error) {
-	tx, err := s.db.Begin(false)
-	if err != nil || true {
-		return 0, false, err
-	}
-	defer func() { _ = tx.Rollback() }()
-
-	user := tx.Bucket(i642b(userID))
-	if user == nil {
-		return 0, false, nil
-	}
-
-	channels := user.Bucket([]byte("channels"))
-	if channels == nil {
-		return 0, false, nil
-	}
+func (s *BoltState) GetChannelPts(ctx context.Context, userID, channelID int64) (pts int, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(userID))
+		if user == nil {
+			return nil
+		}
+		channels := user.Bucket(channelsBucket)
+		if channels == nil {
+			return nil
+		}
 
-	pts := channels.Get(i642b(channelID))
-	if pts == nil {
-		return 0, false, nil
-	}
-	return b2i(pts), true, nil
+		v := channels.Get(i642b(channelID))
+		if v == nil {
+			return nil
+		}
+		pts, found = b2i(v), true
+		return nil
+	})
+	return pts, found, err
 }
 
 func (s *BoltState) SetChannelPts(ctx context.Context, userID, channelID int64, pts int) error {
-	// s.SetChannelPtsM(ctx, userID, channelID, pts)
 	return s.db.Update(func(tx *bolt.Tx) error {
 		user, err := tx.CreateBucketIfNotExists(i642b(userID))
 		if err != nil {
 			return err
 		}
 
-		channels, err := user.CreateBucketIfNotExists([]byte("channels"))
+		channels, err := user.CreateBucketIfNotExists(channelsBucket)
 		if err != nil {
 			return err
 		}
@@ -263,15 +180,52 @@ func (s *BoltState) SetChannelPts(ctx context.Context, userID, channelID int64,
 	})
 }
 
+// SetBatch writes the states and channel pts in one transaction.
+func (s *BoltState) SetBatch(ctx context.Context, batch updates.StateBatch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for userID, state := range batch.States {
+			user, err := tx.CreateBucketIfNotExists(i642b(userID))
+			if err != nil {
+				return err
+			}
+			b, err := user.CreateBucketIfNotExists(stateBucket)
+			if err != nil {
+				return err
+			}
+			if err := putInts(b, "pts", state.Pts, "qts", state.Qts, "date", state.Date, "seq", state.Seq); err != nil {
+				return err
+			}
+		}
+
+		for userID, pts := range batch.Channels {
+			user, err := tx.CreateBucketIfNotExists(i642b(userID))
+			if err != nil {
+				return err
+			}
+			channels, err := user.CreateBucketIfNotExists(channelsBucket)
+			if err != nil {
+				return err
+			}
+			for channelID, v := range pts {
+				if err := channels.Put(i642b(channelID), i2b(v)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteChannelPts forgets the channel, its state is fetched
+// from the server when the next update of the channel comes.
 func (s *BoltState) DeleteChannelPts(ctx context.Context, userID, channelID int64) error {
-	fmt.Println("DeleteChannelPts", userID, channelID)
 	return s.db.Update(func(tx *bolt.Tx) error {
 		user := tx.Bucket(i642b(userID))
 		if user == nil {
 			return nil
 		}
 
-		channels := user.Bucket([]byte("channels"))
+		channels := user.Bucket(channelsBucket)
 		if channels == nil {
 			return nil
 		}
@@ -280,25 +234,132 @@ func (s *BoltState) DeleteChannelPts(ctx context.Context, userID, channelID int6
 	})
 }
 
+// ForEachChannels calls f for the channels of the user outside of
+// the transaction, so f can use the storage.
 func (s *BoltState) ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		user, err := tx.CreateBucketIfNotExists(i642b(userID))
-		if err != nil {
+	type channel struct {
+		id  int64
+		pts int
+	}
+	var list []channel
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(userID))
+		if user == nil {
+			return nil
+		}
+		channels := user.Bucket(channelsBucket)
+		if channels == nil {
+			return nil
+		}
+
+		return channels.ForEach(func(k, v []byte) error {
+			list = append(list, channel{id: b2i64(k), pts: b2i(v)})
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, c := range list {
+		if err := f(ctx, c.id, c.pts); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// boltStateVersion is the version of the state layout in the bolt database.
+//
+// Version 1: the state is kept for every bot. Earlier versions used
+// the same keys and encoding, but could leave a state without some
+// of its keys or with values of a different encoding, such values
+// are dropped.
+const boltStateVersion = 1
+
+var (
+	metaBucket      = []byte("meta")
+	stateVersionKey = []byte("stateVersion")
+)
 
-		channels, err := user.CreateBucketIfNotExists([]byte("channels"))
+// MigrateBoltState upgrades the update state written by earlier versions.
+// States and channel pts readable by this version are kept, bots with
+// a dropped state start from the server state.
+func MigrateBoltState(db *bolt.DB, log *zap.Logger) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
 		if err != nil {
 			return err
 		}
+		version := 0
+		if v := meta.Get(stateVersionKey); v != nil {
+			version = b2i(v)
+		}
+		if version >= boltStateVersion {
+			return nil
+		}
 
-		return channels.ForEach(func(k, v []byte) error {
-			// fmt.Println("ForEachChannels", userID, b2i64(k), b2i(v))
-			return f(ctx, b2i64(k), b2i(v))
-		})
+		// Collect the buckets first, they can't be changed while iterating
+		var users [][]byte
+		if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// Bot buckets are keyed by the bot ID
+			if len(name) == 16 {
+				users = append(users, append([]byte(nil), name...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, name := range users {
+			user := tx.Bucket(name)
+			if err := migrateUserState(user, log.With(zap.Int64("bot_id", b2i64(name)))); err != nil {
+				return errors.Wrapf(err, "Failed to migrate state of %x", name)
+			}
+		}
+
+		return meta.Put(stateVersionKey, i2b(boltStateVersion))
 	})
 }
 
+// migrateUserState drops the state of the bot if it is incomplete
+// and the channel pts which can't be decoded.
+func migrateUserState(user *bolt.Bucket, log *zap.Logger) error {
+	if state := user.Bucket(stateBucket); state != nil {
+		for _, key := range []string{"pts", "qts", "date", "seq"} {
+			if v := state.Get([]byte(key)); len(v) == 8 {
+				continue
+			}
+			log.Warn("Dropping incomplete update state", zap.String("key", key))
+			if err := user.DeleteBucket(stateBucket); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	channels := user.Bucket(channelsBucket)
+	if channels == nil {
+		return nil
+	}
+	var stale [][]byte
+	if err := channels.ForEach(func(k, v []byte) error {
+		if v != nil && (len(k) != 16 || len(v) != 8) {
+			stale = append(stale, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := channels.Delete(k); err != nil {
+			return err
+		}
+	}
+	if len(stale) > 0 {
+		log.Warn("Dropped undecodable channel pts", zap.Int("count", len(stale)))
+	}
+	return nil
+}
+
 var _ updates.ChannelAccessHasher = (*BoltAccessHasher)(nil)
 
 type BoltAccessHasher struct {
@@ -356,3 +417,14 @@ func NewBoltSessionStorage(db *bolt.DB, userID int64) *bbolt.SessionStorage {
 	storage := bbolt.NewSessionStorage(db, "session", i642b(userID))
 	return &storage
 }
+
+// DeleteBoltSession removes the session of the bot, it has to log in again.
+func DeleteBoltSession(db *bolt.DB, userID int64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(userID))
+		if user == nil {
+			return nil
+		}
+		return user.Delete([]byte("session"))
+	})
+}
@@ -0,0 +1,161 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"go-stats/updates"
+)
+
+func newTestBolt(t *testing.T) *bolt.DB {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "db.bbolt"), 0o600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestBoltState(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltState(newTestBolt(t))
+
+	_, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.ErrorIs(t, s.SetPts(ctx, 1, 10), ErrStateNotFound)
+
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}))
+	require.NoError(t, s.SetPts(ctx, 1, 10))
+	require.NoError(t, s.SetQts(ctx, 1, 20))
+	require.NoError(t, s.SetDateSeq(ctx, 1, 30, 40))
+
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 10, Qts: 20, Date: 30, Seq: 40}, state)
+
+	// Bots don't share the state
+	_, found, err = s.GetState(ctx, 2)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestBoltStateChannels(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltState(newTestBolt(t))
+
+	_, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+	require.NoError(t, s.SetChannelPts(ctx, 1, -100, 6))
+	require.NoError(t, s.SetChannelPts(ctx, 2, 100, 7))
+
+	pts, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, pts)
+
+	// The storage can be used while iterating
+	channels := map[int64]int{}
+	require.NoError(t, s.ForEachChannels(ctx, 1, func(ctx context.Context, channelID int64, pts int) error {
+		channels[channelID] = pts
+		return s.SetChannelPts(ctx, 1, channelID, pts+1)
+	}))
+	require.Equal(t, map[int64]int{100: 5, -100: 6}, channels)
+
+	require.NoError(t, s.DeleteChannelPts(ctx, 1, 100))
+	_, found, err = s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	pts, found, err = s.GetChannelPts(ctx, 1, -100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 7, pts)
+}
+
+func TestBoltStateBatch(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltState(newTestBolt(t))
+
+	require.NoError(t, s.SetBatch(ctx, updates.StateBatch{
+		States:   map[int64]updates.State{1: {Pts: 1, Qts: 2, Date: 3, Seq: 4}},
+		Channels: map[int64]map[int64]int{1: {100: 5}, 2: {100: 6}},
+	}))
+
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}, state)
+
+	pts, found, err := s.GetChannelPts(ctx, 2, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 6, pts)
+}
+
+func TestMigrateBoltState(t *testing.T) {
+	ctx := context.Background()
+	db := newTestBolt(t)
+	s := NewBoltState(db)
+	hasher := NewBoltAccessHasher(db)
+
+	// Written by an earlier version
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}))
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+	require.NoError(t, hasher.SetChannelAccessHash(ctx, 1, 100, 42))
+	require.NoError(t, s.SetState(ctx, 2, updates.State{Pts: 1}))
+	require.NoError(t, s.SetChannelPts(ctx, 2, 100, 6))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		user := tx.Bucket(i642b(2))
+		if err := user.Bucket(stateBucket).Delete([]byte("seq")); err != nil {
+			return err
+		}
+		return user.Bucket(channelsBucket).Put(i642b(101), []byte{1})
+	}))
+
+	require.NoError(t, MigrateBoltState(db, zap.NewNop()))
+
+	// The compatible state is kept
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}, state)
+	pts, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, pts)
+	hash, found, err := hasher.GetChannelAccessHash(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(42), hash)
+
+	// The incomplete state and undecodable channel pts are dropped
+	_, found, err = s.GetState(ctx, 2)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.ErrorIs(t, s.SetPts(ctx, 2, 10), ErrStateNotFound)
+	pts, found, err = s.GetChannelPts(ctx, 2, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 6, pts)
+	_, found, err = s.GetChannelPts(ctx, 2, 101)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// The state written after the migration is kept
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 2}))
+	require.NoError(t, MigrateBoltState(db, zap.NewNop()))
+	state, found, err = s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 2, state.Pts)
+}
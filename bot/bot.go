@@ -5,14 +5,13 @@ import (
 	"crypto/sha256"
 	"go-stats/database"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"go-stats/updates"
 
 	"github.com/gotd/td/telegram"
 	"github.com/pkg/errors"
-	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -41,6 +40,7 @@ func UpdateDb(
 		bot.App = app
 		bot.TokenHash = tokenHash
 		bot.LoggedIn = loggedIn
+		bot.Removed = false
 		bot.Source = source
 		if err := db.Create(&bot).Error; err != nil {
 			return errors.Wrap(err, "Failed to add bot to db")
@@ -50,6 +50,7 @@ func UpdateDb(
 	bot.App = app
 	bot.TokenHash = tokenHash
 	bot.LoggedIn = loggedIn
+	bot.Removed = false
 	bot.Source = source
 	if err := tx.Save(&bot).Error; err != nil {
 		return errors.Wrap(err, "Failed to update bot in db")
@@ -75,21 +76,13 @@ func GetFromDb(
 
 func LoginBot(
 	ctx context.Context,
-	boltDb *bolt.DB,
+	session telegram.SessionStorage,
 	apiID int,
 	apiHash string,
 	token string,
 	log *zap.Logger,
 	forceAuth bool,
 ) error {
-	botId := strings.Split(token, ":")[0]
-	botIdInt, err := strconv.ParseInt(botId, 10, 64)
-	if err != nil {
-		return errors.Wrap(err, "Invalid token: bot id is not int")
-	}
-
-	session := NewBoltSessionStorage(boltDb, botIdInt)
-
 	client := telegram.NewClient(apiID, apiHash, telegram.Options{
 		Logger:         log,
 		SessionStorage: session,
@@ -129,56 +122,99 @@ func LoginBot(
 	})
 }
 
+// ErrUnauthorized is returned when the bot session is not authorized.
+var ErrUnauthorized = errors.New("Bot not authorized. Use LoginBot method")
+
+// clientFactory creates a new client and update manager of the bot,
+// a client can not be run again once it is closed.
+type clientFactory func() (*telegram.Client, *updates.Manager)
+
 type TgBot struct {
-	ctx      context.Context
-	cancel   context.CancelFunc
-	client   *telegram.Client
-	gaps     *updates.Manager
-	botID    int64
-	db       *gorm.DB
-	namedLog *zap.Logger
+	ctx        context.Context
+	newClient  clientFactory
+	dispatcher UpdateDispatcher
+	botID      int64
+	db         *gorm.DB
+	namedLog   *zap.Logger
+
+	mux    sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	client *telegram.Client
+	gaps   *updates.Manager
+	// Whether the client was run and has to be recreated
+	used   bool
+	status BotStatus
 }
 
 func NewTgBot(
 	ctx context.Context,
-	client *telegram.Client,
-	gaps *updates.Manager,
+	newClient clientFactory,
+	dispatcher UpdateDispatcher,
 	botID int64,
 	db *gorm.DB,
 	namedLog *zap.Logger,
 ) *TgBot {
+	client, gaps := newClient()
 	return &TgBot{
-		ctx:      ctx,
-		client:   client,
-		gaps:     gaps,
-		botID:    botID,
-		db:       db,
-		namedLog: namedLog,
+		ctx:        ctx,
+		newClient:  newClient,
+		dispatcher: dispatcher,
+		botID:      botID,
+		db:         db,
+		namedLog:   namedLog,
+		client:     client,
+		gaps:       gaps,
+		status:     BotStatus{State: StateStopped, Since: time.Now()},
 	}
 }
 
+// Run runs the bot until it is stopped, restarting it after
+// transient errors. Returns the error which made the bot give up.
 func (b *TgBot) Run(forget bool) error {
 	ctx, cancel := context.WithCancel(b.ctx)
+	done := make(chan struct{})
+	defer close(done)
+
+	// Only one run at a time
+	b.Stop()
+	b.mux.Lock()
 	b.cancel = cancel
+	b.done = done
+	b.mux.Unlock()
 
-	return b.client.Run(ctx, func(ctx context.Context) error {
+	return b.supervise(ctx, forget)
+}
+
+// runOnce runs a new client until it stops.
+func (b *TgBot) runOnce(ctx context.Context, forget bool) error {
+	b.mux.Lock()
+	if b.used {
+		b.client, b.gaps = b.newClient()
+	}
+	b.used = true
+	client, gaps := b.client, b.gaps
+	b.mux.Unlock()
+
+	return client.Run(ctx, func(ctx context.Context) error {
 		// Check auth status.
-		status, err := b.client.Auth().Status(ctx)
+		status, err := client.Auth().Status(ctx)
 		if err != nil {
 			return errors.Wrap(err, "Failed to get auth status")
 		}
 
 		if !status.Authorized {
-			if err := b.db.Where("id = ?", b.botID).Updates(database.Bot{LoggedIn: false}).Error; err != nil {
+			if err := b.db.Model(&database.Bot{}).Where("id = ?", b.botID).Update("logged_in", false).Error; err != nil {
 				b.namedLog.Error("Failed to update bot in db", zap.Error(err))
 			}
-			return errors.New("Bot not authorized. Use LoginBot method")
+			return ErrUnauthorized
 		}
 
 		b.namedLog.Info("Bot login restored", zap.String("name", status.User.Username))
+		b.setState(StateRunning, nil)
 
 		// Notify update manager about authentication.
-		return b.gaps.Run(ctx, b.client.API(), status.User.ID, updates.AuthOptions{
+		return gaps.Run(ctx, client.API(), status.User.ID, updates.AuthOptions{
 			IsBot:  status.User.Bot,
 			Forget: forget,
 			OnStart: func(ctx context.Context) {
@@ -188,6 +224,45 @@ func (b *TgBot) Run(forget bool) error {
 	})
 }
 
+// Running reports whether the bot client is running.
+func (b *TgBot) Running() bool {
+	return b.Status().State == StateRunning
+}
+
+// Stop stops the bot and waits until its client is closed.
 func (b *TgBot) Stop() {
-	b.cancel()
+	b.mux.Lock()
+	cancel, done := b.cancel, b.done
+	b.mux.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Flush persists the buffered update state of the current run.
+func (b *TgBot) Flush(ctx context.Context) error {
+	b.mux.Lock()
+	gaps := b.gaps
+	b.mux.Unlock()
+	return gaps.Flush(ctx)
+}
+
+// Client returns the client of the current run.
+func (b *TgBot) Client() *telegram.Client {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.client
+}
+
+// Logout terminates the session of the running bot on the server.
+func (b *TgBot) Logout(ctx context.Context) error {
+	if !b.Running() {
+		return errors.New("Bot is not running")
+	}
+	if _, err := b.Client().API().AuthLogOut(ctx); err != nil {
+		return errors.Wrap(err, "Failed to log out")
+	}
+	return nil
 }
@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"go-stats/database"
+	"go-stats/updates"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dispatchChannelGap records the channel updates lost on
+// updates.channelDifferenceTooLong as a "gap" event, so the
+// affected period can be excluded from the stats. The chat type
+// is taken from the known chats and is empty for an unknown channel.
+func (u *UpdateDispatcher) dispatchChannelGap(ctx context.Context, gap updates.ChannelGap) {
+	u.logger.Warn("Channel updates lost",
+		zap.Int64("channel_id", gap.ChannelID),
+		zap.Int("from_pts", gap.FromPts),
+		zap.Int("to_pts", gap.ToPts),
+	)
+
+	event := database.Event{
+		Source:             *u.botSource,
+		App:                *u.botApp,
+		BotID:              u.botId,
+		EventType:          "gap",
+		EventSubtype:       "ChannelDifferenceTooLong",
+		Data:               []string{},
+		DataLowCardinality: []string{},
+		DataInt:            []int64{},
+		DataFlags:          []bool{},
+		Fields:             map[string]string{},
+		ChatID:             gap.ChannelID,
+		ChatType:           u.knownChatType(ctx, gap.ChannelID),
+		AbMask:             []string{},
+		Timestamp:          gap.To,
+	}
+	info := &ExtractedInfo{fields: event.Fields}
+	info.setInt(fieldFromPts, int64(gap.FromPts))
+	info.setInt(fieldToPts, int64(gap.ToPts))
+	info.setInt(fieldLostUpdates, int64(gap.ToPts-gap.FromPts))
+	if !gap.From.IsZero() {
+		info.setInt(fieldGapFrom, gap.From.Unix())
+	}
+
+	event.EventID = eventID(&event, fmt.Sprintf("gap:%d:%d:%d", gap.ChannelID, gap.FromPts, gap.ToPts))
+	u.sink.Push(&event)
+	u.metrics.channelGaps.Add(1)
+	u.metrics.lastGap.Store(time.Now().UnixNano())
+}
+
+// knownChatType returns the type of the chat recorded by updateChat,
+// empty if the chat is not known.
+func (u *UpdateDispatcher) knownChatType(ctx context.Context, chatID int64) string {
+	var types []string
+	if err := u.db.WithContext(ctx).Model(&database.Chat{}).
+		Where("bot_id = ? AND chat_id = ?", u.botId, chatID).
+		Limit(1).
+		Pluck("chat_type", &types).Error; err != nil {
+		u.logger.Warn("Failed to get chat type", zap.Int64("chat_id", chatID), zap.Error(err))
+		return ""
+	}
+	if len(types) == 0 {
+		return ""
+	}
+	return types[0]
+}
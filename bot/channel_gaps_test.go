@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go-stats/database"
+	"go-stats/updates"
+)
+
+type testSink struct {
+	events []*database.Event
+}
+
+func (s *testSink) Push(event *database.Event) { s.events = append(s.events, event) }
+
+func (s *testSink) Close() error { return nil }
+
+func TestDispatchChannelGap(t *testing.T) {
+	var (
+		sink   = &testSink{}
+		source = "source"
+		app    = "app"
+	)
+	// The chat type can't be looked up and is left empty
+	u := NewUpdateDispatcher(1, &source, &app, newFailingDB(t), sink, DispatchConfig{}, zap.NewNop())
+	defer u.stopWorkers()
+
+	to := time.Unix(2000, 0)
+	gap := updates.ChannelGap{ChannelID: 100, FromPts: 10, ToPts: 60, To: to}
+	u.dispatchChannelGap(context.Background(), gap)
+	gap.From = time.Unix(1000, 0)
+	u.dispatchChannelGap(context.Background(), gap)
+
+	require.Len(t, sink.events, 2)
+	event := sink.events[0]
+	require.Equal(t, "gap", event.EventType)
+	require.Equal(t, int64(100), event.ChatID)
+	require.Empty(t, event.ChatType)
+	require.Equal(t, to, event.Timestamp)
+	require.Equal(t, map[string]string{"from_pts": "10", "to_pts": "60", "lost_updates": "50"}, event.Fields)
+	require.Equal(t, "1000", sink.events[1].Fields["gap_from"])
+	// The same gap reported twice gets the same ID
+	require.Equal(t, event.EventID, sink.events[1].EventID)
+
+	status := (&TgBot{dispatcher: u}).Status()
+	require.Equal(t, int64(2), status.ChannelGaps)
+	require.NotNil(t, status.LastChannelGap)
+}
+
+func TestDispatchChannelGapChatType(t *testing.T) {
+	var (
+		db     = newTestPostgres(t)
+		sink   = &testSink{}
+		source = "source"
+		app    = "app"
+	)
+	require.NoError(t, db.Create(&database.Chat{BotID: 1, ChatID: 100, ChatType: "supergroup"}).Error)
+	u := NewUpdateDispatcher(1, &source, &app, db, sink, DispatchConfig{}, zap.NewNop())
+	defer u.stopWorkers()
+
+	u.dispatchChannelGap(context.Background(), updates.ChannelGap{ChannelID: 100, FromPts: 10, ToPts: 60, To: time.Now()})
+	u.dispatchChannelGap(context.Background(), updates.ChannelGap{ChannelID: 200, FromPts: 10, ToPts: 60, To: time.Now()})
+	require.Len(t, sink.events, 2)
+	require.Equal(t, "supergroup", sink.events[0].ChatType)
+	require.Empty(t, sink.events[1].ChatType)
+}
@@ -3,47 +3,64 @@ package bot
 import (
 	"context"
 	"go-stats/database"
+	"go-stats/events"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"go-stats/updates"
 	updhook "go-stats/updates/hook"
 
 	"github.com/gotd/td/telegram"
 	"github.com/pkg/errors"
-	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
 type ConnectionPool struct {
-	ctx     context.Context
-	stateDB *bolt.DB
-	apiID   int
-	apiHash string
-	db      *gorm.DB
-	clickCH chan *database.Event
-	log     *zap.Logger
-	bots    map[int64]*TgBot
+	ctx      context.Context
+	state    updates.StateStorage
+	hasher   updates.ChannelAccessHasher
+	sessions SessionStore
+	apiID    int
+	apiHash  string
+	db       *gorm.DB
+	sink     events.Sink
+	dispatch DispatchConfig
+	log      *zap.Logger
+
+	// Registry of the bots, TgBot instances are never mutated under the lock
+	mux  sync.RWMutex
+	bots map[int64]*TgBot
+	// Set when bots are sharded between instances
+	leases *leaseManager
 }
 
 func NewConnectionPool(
 	ctx context.Context,
-	stateDB *bolt.DB,
+	state updates.StateStorage,
+	hasher updates.ChannelAccessHasher,
+	sessions SessionStore,
 	apiID int,
 	apiHash string,
 	db *gorm.DB,
-	clickCH chan *database.Event,
+	sink events.Sink,
+	dispatchConfig DispatchConfig,
 	log *zap.Logger,
-) ConnectionPool {
-	return ConnectionPool{
-		ctx:     ctx,
-		stateDB: stateDB,
-		apiID:   apiID,
-		apiHash: apiHash,
-		db:      db,
-		clickCH: clickCH,
-		log:     log,
-		bots:    make(map[int64]*TgBot),
+) *ConnectionPool {
+	return &ConnectionPool{
+		ctx:      ctx,
+		state:    state,
+		hasher:   hasher,
+		sessions: sessions,
+		apiID:    apiID,
+		apiHash:  apiHash,
+		db:       db,
+		sink:     sink,
+		dispatch: dispatchConfig,
+		log:      log,
+		bots:     make(map[int64]*TgBot),
 	}
 }
 
@@ -59,35 +76,116 @@ func (c *ConnectionPool) AddBot(botID int64) error {
 	}
 
 	// session := session.FileStorage{Path: "sessions/session_" + strconv.FormatInt(botId, 10)}
-	session := NewBoltSessionStorage(c.stateDB, botID)
-	// storage := NewBoltState(stateDB)
-	accessHasher := NewBoltAccessHasher(c.stateDB)
-	handler := NewUpdateDispatcher(botID, bot.Source, bot.App, c.db, c.clickCH, namedLog.WithOptions(zap.IncreaseLevel(zap.WarnLevel)))
-
-	gaps := updates.New(updates.Config{
-		// Storage:      storage,
-		AccessHasher: accessHasher,
-		Handler:      handler, //handler,
-		Logger:       namedLog,
-	})
+	session := c.sessions.Storage(botID)
+	handler := NewUpdateDispatcher(botID, bot.Source, bot.App, c.db, c.sink, c.dispatch, namedLog.WithOptions(zap.IncreaseLevel(zap.WarnLevel)))
 
-	client := telegram.NewClient(c.apiID, c.apiHash, telegram.Options{
-		Logger:         namedLog,
-		SessionStorage: session,
-		UpdateHandler:  gaps,
-		Middlewares: []telegram.Middleware{
-			updhook.UpdateHook(gaps.Handle),
-		},
-	})
+	newClient := func() (*telegram.Client, *updates.Manager) {
+		gaps := updates.New(updates.Config{
+			Storage:      c.state,
+			AccessHasher: c.hasher,
+			Handler:      handler, //handler,
+			GapRecovery:  c.dispatch.GapRecovery,
+			Logger:       namedLog,
+			// Lost channel updates are reported to the event stream
+			OnChannelTooLong: handler.dispatchChannelGap,
+		})
+
+		client := telegram.NewClient(c.apiID, c.apiHash, telegram.Options{
+			Logger:         namedLog,
+			SessionStorage: session,
+			UpdateHandler:  gaps,
+			Middlewares: []telegram.Middleware{
+				updhook.UpdateHook(gaps.Handle),
+			},
+		})
 
-	handler.addApi(client.API())
+		handler.addApi(client.API())
+		return client, gaps
+	}
 
-	c.bots[botID] = NewTgBot(c.ctx, client, gaps, botID, c.db, namedLog)
+	c.replace(botID, NewTgBot(c.ctx, newClient, handler, botID, c.db, namedLog))
 	return nil
 }
 
-func (c *ConnectionPool) RunBot(botID int64, forget bool) error {
+// replace puts the bot into the registry, the replaced instance is stopped
+// before it returns so two clients never run with the same session.
+func (c *ConnectionPool) replace(botID int64, bot *TgBot) {
+	c.mux.Lock()
+	old, ok := c.bots[botID]
+	if bot == nil {
+		delete(c.bots, botID)
+	} else {
+		c.bots[botID] = bot
+	}
+	c.mux.Unlock()
+
+	if ok {
+		old.Stop()
+		// The state is persisted before another client takes the bot over
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := old.Flush(ctx); err != nil {
+			c.log.Error("Failed to persist update state", zap.Int64("bot", botID), zap.Error(err))
+		}
+		cancel()
+		// Let the queued updates finish in the background
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), slowDispatch)
+			defer cancel()
+			old.dispatcher.wait(ctx)
+			old.dispatcher.stopWorkers()
+		}()
+	}
+}
+
+func (c *ConnectionPool) get(botID int64) (*TgBot, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
 	bot, ok := c.bots[botID]
+	return bot, ok
+}
+
+func (c *ConnectionPool) botIDs() []int64 {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	ids := make([]int64, 0, len(c.bots))
+	for botID := range c.bots {
+		ids = append(ids, botID)
+	}
+	return ids
+}
+
+// StartBot adds the bot and runs it. When bots are sharded, only a bot
+// leased by this instance is started here, other bots are left to the
+// lease owners.
+func (c *ConnectionPool) StartBot(botID int64, forget bool) error {
+	c.mux.RLock()
+	leases := c.leases
+	_, local := c.bots[botID]
+	c.mux.RUnlock()
+	if leases != nil && !local {
+		leases.notify()
+		return nil
+	}
+
+	if err := c.AddBot(botID); err != nil {
+		return err
+	}
+	go func() {
+		if err := c.RunBot(botID, forget); err != nil {
+			c.log.Error("Error running bot", zap.Int64("bot", botID), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// HasBot reports whether the bot is in the pool.
+func (c *ConnectionPool) HasBot(botID int64) bool {
+	_, ok := c.get(botID)
+	return ok
+}
+
+func (c *ConnectionPool) RunBot(botID int64, forget bool) error {
+	bot, ok := c.get(botID)
 	if !ok {
 		return errors.New("Bot not found")
 	}
@@ -95,7 +193,7 @@ func (c *ConnectionPool) RunBot(botID int64, forget bool) error {
 }
 
 func (c *ConnectionPool) StopBot(botID int64) error {
-	bot, ok := c.bots[botID]
+	bot, ok := c.get(botID)
 	if !ok {
 		return errors.New("Bot not found")
 	}
@@ -103,10 +201,99 @@ func (c *ConnectionPool) StopBot(botID int64) error {
 	return nil
 }
 
+// RestartBot stops the bot and runs it with a new client.
+func (c *ConnectionPool) RestartBot(botID int64) error {
+	if err := c.StopBot(botID); err != nil {
+		return err
+	}
+	go func() {
+		if err := c.RunBot(botID, false); err != nil {
+			c.log.Error("Error running bot", zap.Int64("bot", botID), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// RemoveBot stops the bot and removes it from the pool. The bot is not
+// run by any instance until it is added again.
+func (c *ConnectionPool) RemoveBot(botID int64) error {
+	tx := c.db.Model(&database.Bot{}).Where("id = ?", botID).Update("removed", true)
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "Failed to update bot in db")
+	}
+	if tx.RowsAffected == 0 {
+		return errors.New("Bot not found")
+	}
+	c.replace(botID, nil)
+	return nil
+}
+
+// LogoutBot logs the bot out, removes it from the pool and clears its session.
+// The bot has to be added with a token again.
+func (c *ConnectionPool) LogoutBot(ctx context.Context, botID int64) error {
+	if bot, ok := c.get(botID); ok {
+		logoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := bot.Logout(logoutCtx); err != nil {
+			c.log.Warn("Failed to log out bot, clearing the session anyway", zap.Int64("bot", botID), zap.Error(err))
+		}
+		cancel()
+		c.replace(botID, nil)
+	}
+
+	if err := c.sessions.Delete(botID); err != nil {
+		return errors.Wrap(err, "Failed to delete session")
+	}
+	if err := c.db.Model(&database.Bot{}).Where("id = ?", botID).Update("logged_in", false).Error; err != nil {
+		return errors.Wrap(err, "Failed to update bot in db")
+	}
+	return nil
+}
+
+// BotStatus returns the state of the bot.
+func (c *ConnectionPool) BotStatus(botID int64) (BotStatus, error) {
+	bot, ok := c.get(botID)
+	if !ok {
+		return BotStatus{}, errors.New("Bot not found")
+	}
+	return bot.Status(), nil
+}
+
+// BotStatuses returns the states of all bots ordered by bot ID.
+func (c *ConnectionPool) BotStatuses() []BotStatus {
+	c.mux.RLock()
+	bots := make([]*TgBot, 0, len(c.bots))
+	for _, bot := range c.bots {
+		bots = append(bots, bot)
+	}
+	c.mux.RUnlock()
+
+	statuses := make([]BotStatus, 0, len(bots))
+	for _, bot := range bots {
+		statuses = append(statuses, bot.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].BotID < statuses[j].BotID
+	})
+	return statuses
+}
+
+// SessionStorage returns the session storage of the bot.
+func (c *ConnectionPool) SessionStorage(botID int64) telegram.SessionStorage {
+	return c.sessions.Storage(botID)
+}
+
 func (c *ConnectionPool) GetApi(botID int64) (*telegram.Client, error) {
-	bot, ok := c.bots[botID]
+	bot, ok := c.get(botID)
 	if !ok {
 		return nil, errors.New("Bot not found")
 	}
-	return bot.client, nil
+	return bot.Client(), nil
+}
+
+func (c *ConnectionPool) PushCustomEvents(ctx context.Context, botID int64, customEvents []CustomEvent) error {
+	bot, ok := c.get(botID)
+	if !ok {
+		return errors.New("Bot not found")
+	}
+	return bot.dispatcher.DispatchCustom(ctx, customEvents)
 }
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gotd/td/telegram"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go-stats/updates"
+)
+
+func newTestPool(ctx context.Context) *ConnectionPool {
+	return NewConnectionPool(ctx, nil, nil, nil, 1, "hash", nil, &testSink{}, DispatchConfig{}, zap.NewNop())
+}
+
+// newTestBot creates a bot which never connects, its context has to be
+// cancelled so the client stops right away.
+func newTestBot(t *testing.T, ctx context.Context, botID int64) *TgBot {
+	t.Helper()
+
+	source, app := "source", "app"
+	dispatcher := NewUpdateDispatcher(botID, &source, &app, nil, &testSink{}, DispatchConfig{}, zap.NewNop())
+	t.Cleanup(dispatcher.stopWorkers)
+
+	newClient := func() (*telegram.Client, *updates.Manager) {
+		gaps := updates.New(updates.Config{Handler: dispatcher})
+		return telegram.NewClient(1, "hash", telegram.Options{UpdateHandler: gaps}), gaps
+	}
+	return NewTgBot(ctx, newClient, dispatcher, botID, nil, zap.NewNop())
+}
+
+func TestConnectionPoolBots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := newTestPool(ctx)
+
+	require.False(t, pool.HasBot(1))
+	require.Error(t, pool.RunBot(1, false))
+
+	pool.replace(1, newTestBot(t, ctx, 1))
+	require.True(t, pool.HasBot(1))
+	require.False(t, pool.HasBot(2))
+
+	// The stopped pool context stops the bot
+	require.NoError(t, pool.RunBot(1, false))
+	status, err := pool.BotStatus(1)
+	require.NoError(t, err)
+	require.Equal(t, StateStopped, status.State)
+
+	pool.replace(1, nil)
+	require.False(t, pool.HasBot(1))
+	require.Error(t, pool.RunBot(1, false))
+}
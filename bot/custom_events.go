@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"go-stats/database"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// CustomEvent is an event reported by the bot backend, something
+// the bot knows about its users which never shows up in updates.
+type CustomEvent struct {
+	// Optional ID unique for the bot, events with the same ID are written once.
+	ID        string
+	Name      string
+	UserID    int64
+	ChatID    int64
+	ContentID string
+	Language  string
+	Fields    map[string]string
+	Timestamp time.Time
+}
+
+// DispatchCustom enriches the custom events with the user info
+// like raw events and pushes them to the sink. Nothing is pushed
+// if an event fails, so the batch can be retried.
+func (u *UpdateDispatcher) DispatchCustom(ctx context.Context, customEvents []CustomEvent) error {
+	for i, custom := range customEvents {
+		if custom.Name == "" {
+			return errors.Errorf("Event %d has no name", i)
+		}
+	}
+
+	now := time.Now()
+	events := make([]*database.Event, 0, len(customEvents))
+	// IDs are remembered once the events are pushed
+	var ids []uint64
+	batchIDs := map[uint64]bool{}
+	for i, custom := range customEvents {
+		event := database.Event{
+			Source:             *u.botSource,
+			App:                *u.botApp,
+			BotID:              u.botId,
+			EventType:          "custom",
+			EventSubtype:       custom.Name,
+			FromBot:            false,
+			Data:               []string{},
+			DataLowCardinality: []string{},
+			DataInt:            []int64{},
+			DataFlags:          []bool{},
+			Fields:             custom.Fields,
+			ChatID:             custom.ChatID,
+			UserID:             custom.UserID,
+			ContentID:          custom.ContentID,
+			Language:           custom.Language,
+			AbMask:             []string{},
+			Timestamp:          custom.Timestamp,
+		}
+		if event.Fields == nil {
+			event.Fields = map[string]string{}
+		}
+		if event.Timestamp.IsZero() {
+			event.Timestamp = now
+		}
+
+		key := fmt.Sprintf("custom:%d:%d", now.UnixNano(), i)
+		if custom.ID != "" {
+			key = "custom:" + custom.ID
+		}
+		event.EventID = eventID(&event, key)
+		if custom.ID != "" {
+			if batchIDs[event.EventID] || u.dedup.has(event.EventID) {
+				continue
+			}
+			batchIDs[event.EventID] = true
+			ids = append(ids, event.EventID)
+		}
+
+		if event.UserID != 0 {
+			info := &ExtractedInfo{
+				userID:        custom.UserID,
+				chatID:        custom.ChatID,
+				updateSession: true,
+				timestamp:     event.Timestamp,
+			}
+			if err := u.addUserInfoToEvent(ctx, &event, info, Entities{}); err != nil {
+				return errors.Wrapf(err, "Failed to add user info to event %d", i)
+			}
+			if event.Language == "" {
+				event.Language = u.userLanguage(event.UserID)
+			}
+		}
+		events = append(events, &event)
+	}
+
+	for _, event := range events {
+		u.sink.Push(event)
+	}
+	u.metrics.events.add(int64(len(events)))
+	for _, id := range ids {
+		u.dedup.seen(id)
+	}
+	return nil
+}
+
+// userLanguage returns the last known language of the user.
+func (u *UpdateDispatcher) userLanguage(userID int64) string {
+	user := database.TgUser{UserID: userID}
+	if err := u.db.Where(&user).First(&user).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			u.logger.Warn("Failed to get user language", zap.Error(err))
+		}
+		return ""
+	}
+	return user.LanguageCode
+}
@@ -0,0 +1,51 @@
+package bot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newFailingDB returns a db on which every query fails.
+func newFailingDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1 connect_timeout=1"}), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	return db
+}
+
+func TestDispatchCustomRetry(t *testing.T) {
+	var (
+		db     = newFailingDB(t)
+		ctx    = context.Background()
+		sink   = &testSink{}
+		source = "source"
+		app    = "app"
+	)
+	u := NewUpdateDispatcher(1, &source, &app, db, sink, DispatchConfig{}, zap.NewNop())
+	defer u.stopWorkers()
+
+	// The user of the second event can't be enriched
+	require.Error(t, u.DispatchCustom(ctx, []CustomEvent{
+		{ID: "a", Name: "purchase"},
+		{ID: "b", Name: "purchase", UserID: 5},
+	}))
+	require.Empty(t, sink.events)
+
+	// The retry is not taken for a duplicate
+	require.NoError(t, u.DispatchCustom(ctx, []CustomEvent{
+		{ID: "a", Name: "purchase"},
+		{ID: "a", Name: "purchase"},
+	}))
+	require.Len(t, sink.events, 1)
+
+	require.NoError(t, u.DispatchCustom(ctx, []CustomEvent{{ID: "a", Name: "purchase"}}))
+	require.Len(t, sink.events, 1)
+}
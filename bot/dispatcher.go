@@ -4,8 +4,9 @@ import (
 	"context"
 	"fmt"
 	"go-stats/database"
-	"go-stats/keymutex"
+	"go-stats/events"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gotd/td/tg"
@@ -24,25 +25,33 @@ type UpdateDispatcher struct {
 	botApp            *string
 	db                *gorm.DB
 	api               *tg.Client
-	clickCh           chan *database.Event
+	sink              events.Sink
 	logger            *zap.Logger
-	keymutex          *keymutex.KeyMutex
 	updateChatIDMutex *deadlock.RWMutex
+	dedup             *eventDedup
+	metrics           *dispatchMetrics
+	inflight          *sync.WaitGroup
+	workers           *workerPool
 }
 
-func NewUpdateDispatcher(botId int64, botSource *string, botApp *string, db *gorm.DB, clickCh chan *database.Event, logger *zap.Logger) UpdateDispatcher {
-	return UpdateDispatcher{
+func NewUpdateDispatcher(botId int64, botSource *string, botApp *string, db *gorm.DB, sink events.Sink, dispatchConfig DispatchConfig, logger *zap.Logger) UpdateDispatcher {
+	u := UpdateDispatcher{
 		handlers:          map[uint32]handler{},
 		botId:             botId,
 		botSource:         botSource,
 		botApp:            botApp,
 		db:                db,
 		api:               nil,
-		clickCh:           clickCh,
+		sink:              sink,
 		logger:            logger,
-		keymutex:          keymutex.New(47),
 		updateChatIDMutex: &deadlock.RWMutex{},
+		dedup:             newEventDedup(10000),
+		metrics:           &dispatchMetrics{},
+		inflight:          &sync.WaitGroup{},
+		workers:           newWorkerPool(dispatchConfig),
 	}
+	u.startWorkers()
+	return u
 }
 
 type Entities struct {
@@ -70,22 +79,27 @@ func (u UpdateDispatcher) Handle(ctx context.Context, updates tg.UpdatesClass) e
 	var (
 		e    Entities
 		upds []tg.UpdateClass
+		date int
 	)
+	u.metrics.updateReceived()
 	switch u := updates.(type) {
 	case *tg.Updates:
 		upds = u.Updates
+		date = u.Date
 		e.Users = u.MapUsers().NotEmptyToMap()
 		chats := u.MapChats()
 		e.Chats = chats.ChatToMap()
 		e.Channels = chats.ChannelToMap()
 	case *tg.UpdatesCombined:
 		upds = u.Updates
+		date = u.Date
 		e.Users = u.MapUsers().NotEmptyToMap()
 		chats := u.MapChats()
 		e.Chats = chats.ChatToMap()
 		e.Channels = chats.ChannelToMap()
 	case *tg.UpdateShort:
 		upds = []tg.UpdateClass{u.Update}
+		date = u.Date
 		e.short()
 	default:
 		// *UpdateShortMessage
@@ -94,6 +108,7 @@ func (u UpdateDispatcher) Handle(ctx context.Context, updates tg.UpdatesClass) e
 		// *UpdatesTooLong
 		return nil
 	}
+	u.metrics.updateSent(date)
 
 	var err error
 	for _, update := range upds {
@@ -102,34 +117,33 @@ func (u UpdateDispatcher) Handle(ctx context.Context, updates tg.UpdatesClass) e
 	return err
 }
 
+// dispatch queues the update to the worker of its chat, updates of
+// the same chat are processed in order. Blocks when the queue is full.
 func (u *UpdateDispatcher) dispatch(ctx context.Context, e Entities, update tg.UpdateClass) error {
-	go func() {
-		ch := make(chan struct{})
-		go func() {
-			t := time.NewTimer(time.Second * 30)
-			defer t.Stop() // This runs after the losure finishes, but it's OK.
-			select {
-			case <-t.C:
-				u.logger.Error("UpdateDispatcher.dispatch timeout", zap.String("update", fmt.Sprintf("%T", update)))
-				return
-			case <-ch:
-				return
-			}
-
-		}()
-		err := u.dispatchSync(ctx, e, update)
-		if err != nil {
-			u.logger.Error("Error dispatching update", zap.Error(err))
-		}
-		close(ch)
-	}()
+	if update == nil {
+		return nil
+	}
+	u.enqueue(dispatchJob{ctx: ctx, e: e, update: update, info: handle(update)})
 	return nil
 }
 
-func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update tg.UpdateClass) error {
-	if update == nil {
-		return nil
+// wait waits for the dispatched updates until the context is done.
+// Returns the number of updates still being dispatched.
+func (u *UpdateDispatcher) wait(ctx context.Context) int64 {
+	done := make(chan struct{})
+	go func() {
+		u.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return u.metrics.inflight.Load()
 	}
+}
+
+func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update tg.UpdateClass, info *ExtractedInfo) error {
 	// fmt.Println(update)
 	// Handle updates here, e.g., print the update
 	event := database.Event{
@@ -143,6 +157,7 @@ func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update
 		DataLowCardinality: []string{},
 		DataInt:            []int64{},
 		DataFlags:          []bool{},
+		Fields:             map[string]string{},
 		ChatID:             0,
 		ChatType:           "",
 		UserID:             0,
@@ -156,17 +171,26 @@ func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update
 		AbMask:             []string{},
 		Timestamp:          time.Now(),
 	}
-	info := handle(update)
 	// fmt.Println("Info from bot: ", info)
 	event.FromBot = info.fromBot
 	event.Data = info.data
 	event.DataLowCardinality = info.dataLowCardinality
 	event.DataInt = info.dataInt
 	event.DataFlags = info.dataFlags
+	event.Fields = info.fields
 	event.ChatID = info.chatID
 	event.UserID = info.userID
 	event.Timestamp = info.timestamp
 
+	// The same update can be delivered more than once (several sessions,
+	// replays after reconnect), process it only once. Updates
+	// without a natural key can't be told apart and are kept.
+	event.EventID = eventID(&event, info.key)
+	if info.key != "" && u.dedup.seen(event.EventID) {
+		u.logger.Debug("Duplicate update skipped", zap.String("update", update.TypeName()))
+		return nil
+	}
+
 	if info.chatID != 0 {
 		_, okUser := e.Users[info.chatID]
 		if okUser {
@@ -191,7 +215,8 @@ func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update
 		if event.UserID != 0 {
 			u.addUserInfoToEvent(ctx, &event, info, e)
 		}
-		u.clickCh <- &event
+		u.sink.Push(&event)
+		u.metrics.events.add(1)
 	}
 
 	// fmt.Println("Update from bot: ", update.TypeName())
@@ -208,40 +233,42 @@ func (u *UpdateDispatcher) dispatchSync(ctx context.Context, e Entities, update
 	return nil
 }
 
+// addUserInfoToEvent records the user action and copies the session and
+// referers of the user to the event. A new session starts after 5 minutes
+// of inactivity.
 func (u *UpdateDispatcher) addUserInfoToEvent(ctx context.Context, event *database.Event, info *ExtractedInfo, e Entities) error {
-	u.keymutex.LockID(uint(event.UserID))
-	defer u.keymutex.UnlockID(uint(event.UserID))
-
 	if user, okUser := e.Users[event.UserID]; okUser {
 		event.Language, _ = user.GetLangCode()
 	}
 
-	userDb := database.User{BotID: event.BotID, UserID: event.UserID}
-	if tx := u.db.Where(&userDb).First(&userDb); tx.Error != nil {
-		if tx.Error != gorm.ErrRecordNotFound {
-			return tx.Error
-		}
-		userDb.UserID = event.UserID
-		userDb.BotID = event.BotID
-		userDb.FirstActionTime = info.timestamp
-		userDb.LastActionTime = info.timestamp
-		userDb.RefererID = info.referer
-		userDb.SessionID = int16(1)
-		userDb.SessionRefererID = info.referer
-		u.db.Create(&userDb)
-	} else if info.updateSession {
-		if userDb.LastActionTime.Before(info.timestamp.Add(-time.Minute * 5)) {
-			userDb.SessionID++
-			userDb.SessionRefererID = info.referer
-		}
-		userDb.LastActionTime = info.timestamp
-		tx.Save(&userDb)
+	var userDb database.User
+	err := u.db.Raw(`
+		INSERT INTO users (bot_id, user_id, first_action_time, last_action_time, referer_id, session_id, session_referer_id)
+		VALUES (@bot, @user, @ts, @ts, @referer, 1, @referer)
+		ON CONFLICT (bot_id, user_id) DO UPDATE SET
+			session_id = CASE WHEN @session AND users.last_action_time < EXCLUDED.last_action_time - interval '5 minutes'
+				THEN users.session_id + 1 ELSE users.session_id END,
+			session_referer_id = CASE WHEN @session AND users.last_action_time < EXCLUDED.last_action_time - interval '5 minutes'
+				THEN EXCLUDED.session_referer_id ELSE users.session_referer_id END,
+			last_action_time = CASE WHEN @session
+				THEN GREATEST(users.last_action_time, EXCLUDED.last_action_time) ELSE users.last_action_time END
+		RETURNING first_action_time, referer_id, session_id, session_referer_id`,
+		map[string]interface{}{
+			"bot":     event.BotID,
+			"user":    event.UserID,
+			"ts":      info.timestamp,
+			"referer": info.referer,
+			"session": info.updateSession,
+		},
+	).Scan(&userDb).Error
+	if err != nil {
+		return err
 	}
 
 	event.SessionID = userDb.SessionID
 	event.Referer = userDb.RefererID
 	event.SessionReferer = userDb.SessionRefererID
-	event.UserCreatedAt = &userDb.FirstActionTime
+	event.UserCreatedAt = userDb.FirstActionTime
 	return nil
 }
 
@@ -361,43 +388,46 @@ func max(a, b time.Time) time.Time {
 	return b
 }
 
+// updateChat records the chat action. The chat type and the write
+// permissions are changed only by updates newer than the last change,
+// a ban revokes the permission to write.
 func (u *UpdateDispatcher) updateChat(ctx context.Context, info *ExtractedInfo, canWrite bool, ban bool) error {
 	u.updateChatIDMutex.RLock()
 	defer u.updateChatIDMutex.RUnlock()
 
-	u.keymutex.LockID(uint(info.chatID))
-	defer u.keymutex.UnlockID(uint(info.chatID))
-
-	chat := database.Chat{BotID: u.botId, ChatID: info.chatID}
-	tx := u.db.Where(&chat).First(&chat)
-	if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
-		return tx.Error
-	}
-	if tx.Error == gorm.ErrRecordNotFound {
-		chat.ChatType = info.chatType
-		chat.FirstActionTime = info.timestamp
-		chat.LastActionTime = info.timestamp
-		chat.LastUpdateTime = info.timestamp
-		chat.RefererID = info.referer
-		chat.CanWrite = canWrite
-		chat.WasBanned = ban
-		return u.db.Create(&chat).Error
-	}
-
-	chat.LastActionTime = max(chat.LastActionTime, info.timestamp)
-	if !info.timestamp.Before(chat.LastUpdateTime) && info.chatType != "" && chat.ChatType != info.chatType {
-		chat.ChatType = info.chatType
-		chat.LastUpdateTime = info.timestamp
-	}
-	if !info.timestamp.Before(chat.LastUpdateTime) && (canWrite || ban) {
-		chat.CanWrite = !ban && (chat.CanWrite || canWrite)
-		chat.WasBanned = chat.WasBanned || ban
-		chat.LastUpdateTime = info.timestamp
-	}
-
-	return tx.Save(&chat).Error
+	return u.db.Exec(`
+		INSERT INTO chats (bot_id, chat_id, chat_type, first_action_time, last_action_time, last_update_time, referer_id, can_write, was_banned)
+		VALUES (@bot, @chat, @type, @ts, @ts, @ts, @referer, @canWrite, @ban)
+		ON CONFLICT (bot_id, chat_id) DO UPDATE SET
+			last_action_time = GREATEST(chats.last_action_time, EXCLUDED.last_action_time),
+			chat_type = CASE WHEN `+chatTypeChanged+`
+				THEN EXCLUDED.chat_type ELSE chats.chat_type END,
+			can_write = CASE WHEN `+chatAccessChanged+`
+				THEN NOT EXCLUDED.was_banned AND (chats.can_write OR EXCLUDED.can_write) ELSE chats.can_write END,
+			was_banned = CASE WHEN `+chatAccessChanged+`
+				THEN chats.was_banned OR EXCLUDED.was_banned ELSE chats.was_banned END,
+			last_update_time = CASE WHEN `+chatTypeChanged+` OR `+chatAccessChanged+`
+				THEN EXCLUDED.last_update_time ELSE chats.last_update_time END`,
+		map[string]interface{}{
+			"bot":      u.botId,
+			"chat":     info.chatID,
+			"type":     info.chatType,
+			"ts":       info.timestamp,
+			"referer":  info.referer,
+			"canWrite": canWrite,
+			"ban":      ban,
+		},
+	).Error
 }
 
+// Conditions of updateChat, EXCLUDED holds the values of the update.
+const (
+	chatTypeChanged = `(EXCLUDED.last_update_time >= chats.last_update_time
+		AND EXCLUDED.chat_type <> '' AND EXCLUDED.chat_type <> chats.chat_type)`
+	chatAccessChanged = `(EXCLUDED.last_update_time >= chats.last_update_time
+		AND (EXCLUDED.can_write OR EXCLUDED.was_banned))`
+)
+
 func (u *UpdateDispatcher) updateChatID(ctx context.Context, oldID int64, newID int64) error {
 	if oldID == newID {
 		return nil
@@ -446,6 +476,8 @@ func (u *UpdateDispatcher) updateChatID(ctx context.Context, oldID int64, newID
 	return err
 }
 
+// updateChatMember records the member action. Joins and leaves older
+// than the last join or leave are ignored.
 func (u *UpdateDispatcher) updateChatMember(
 	ctx context.Context,
 	chatID int64,
@@ -456,78 +488,65 @@ func (u *UpdateDispatcher) updateChatMember(
 	joinUrl string,
 	actorId int64,
 ) error {
-	// This function can be called concurrently from different bots, so we need to handle dublicate key error
-	err := u.updateChatMemberLocked(ctx, chatID, memberID, info, join, leave, joinUrl, actorId)
-	if err == gorm.ErrDuplicatedKey {
-		return u.updateChatMemberLocked(ctx, chatID, memberID, info, join, leave, joinUrl, actorId)
-	}
-	return err
-}
-
-func (u *UpdateDispatcher) updateChatMemberLocked(
-	ctx context.Context,
-	chatID int64,
-	memberID int64,
-	info *ExtractedInfo,
-	join bool,
-	leave bool,
-	joinUrl string,
-	actorId int64,
-) error {
-	// TODO: This function can be called concurrently from different bots,
-	//       so we need to check all edge cases
-
 	u.updateChatIDMutex.RLock()
 	defer u.updateChatIDMutex.RUnlock()
 
-	u.keymutex.LockID(uint(chatID))
-	defer u.keymutex.UnlockID(uint(chatID))
-
-	chatMember := database.ChatMember{ChatID: chatID, UserID: memberID}
-	tx := u.db.Where(&chatMember).First(&chatMember)
-	if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
-		return tx.Error
-	}
-	if tx.Error == gorm.ErrRecordNotFound && join {
+	// The row inserted for a member seen for the first time
+	chatMember := database.ChatMember{ChatID: chatID, UserID: memberID, LastActionTime: info.timestamp, IsMember: true}
+	switch {
+	case join:
 		chatMember.FirstJoinTime = &info.timestamp
 		chatMember.LastJoinTime = &info.timestamp
-		chatMember.LastActionTime = info.timestamp
 		chatMember.JoinUrl = joinUrl
 		chatMember.FirstJoinActorId = actorId
 		chatMember.LastJoinActorId = actorId
 		chatMember.IsMember = !leave
-		return u.db.Create(&chatMember).Error
-	}
-	if tx.Error == gorm.ErrRecordNotFound && leave {
-		chatMember.LastLeaveTime = &info.timestamp
-		chatMember.LastActionTime = info.timestamp
-		chatMember.LastLeaveActorId = actorId
-		chatMember.IsMember = false
-		return u.db.Create(&chatMember).Error
-	}
-	if tx.Error == gorm.ErrRecordNotFound {
-		chatMember.LastActionTime = info.timestamp
-		chatMember.IsMember = true
-		return u.db.Create(&chatMember).Error
-	}
-
-	canApplyJoin := chatMember.LastJoinTime == nil || !info.timestamp.Before(*chatMember.LastJoinTime)
-	canApplyLeave := chatMember.LastLeaveTime == nil || !info.timestamp.Before(*chatMember.LastLeaveTime)
-	canApply := canApplyJoin && canApplyLeave
-	if canApply && join {
-		chatMember.LastJoinTime = &info.timestamp
-		chatMember.LastJoinActorId = actorId
-		chatMember.IsMember = true
-		if chatMember.JoinUrl == "" {
-			chatMember.JoinUrl = joinUrl
-		}
-	}
-	if canApply && leave {
+	case leave:
 		chatMember.LastLeaveTime = &info.timestamp
 		chatMember.LastLeaveActorId = actorId
 		chatMember.IsMember = false
 	}
 
-	chatMember.LastActionTime = max(info.timestamp, chatMember.LastActionTime)
-	return tx.Save(&chatMember).Error
+	return u.db.Exec(`
+		INSERT INTO chatmembers (chat_id, user_id, first_join_time, last_join_time, last_leave_time, last_action_time,
+			is_member, first_join_actor_id, last_join_actor_id, last_leave_actor_id, join_url)
+		VALUES (@chat, @user, @firstJoin, @lastJoin, @lastLeave, @ts, @member, @firstJoinActor, @lastJoinActor, @lastLeaveActor, @url)
+		ON CONFLICT (chat_id, user_id) DO UPDATE SET
+			last_join_time = CASE WHEN @join AND `+memberCanApply+`
+				THEN @ts ELSE chatmembers.last_join_time END,
+			last_join_actor_id = CASE WHEN @join AND `+memberCanApply+`
+				THEN @actor ELSE chatmembers.last_join_actor_id END,
+			join_url = CASE WHEN @join AND `+memberCanApply+` AND chatmembers.join_url = ''
+				THEN @joinUrl ELSE chatmembers.join_url END,
+			last_leave_time = CASE WHEN @leave AND `+memberCanApply+`
+				THEN @ts ELSE chatmembers.last_leave_time END,
+			last_leave_actor_id = CASE WHEN @leave AND `+memberCanApply+`
+				THEN @actor ELSE chatmembers.last_leave_actor_id END,
+			is_member = CASE
+				WHEN @leave AND `+memberCanApply+` THEN false
+				WHEN @join AND `+memberCanApply+` THEN true
+				ELSE chatmembers.is_member END,
+			last_action_time = GREATEST(chatmembers.last_action_time, EXCLUDED.last_action_time)`,
+		map[string]interface{}{
+			"chat":           chatMember.ChatID,
+			"user":           chatMember.UserID,
+			"firstJoin":      chatMember.FirstJoinTime,
+			"lastJoin":       chatMember.LastJoinTime,
+			"lastLeave":      chatMember.LastLeaveTime,
+			"ts":             info.timestamp,
+			"member":         chatMember.IsMember,
+			"firstJoinActor": chatMember.FirstJoinActorId,
+			"lastJoinActor":  chatMember.LastJoinActorId,
+			"lastLeaveActor": chatMember.LastLeaveActorId,
+			"url":            chatMember.JoinUrl,
+			"join":           join,
+			"leave":          leave,
+			"actor":          actorId,
+			"joinUrl":        joinUrl,
+		},
+	).Error
 }
+
+// memberCanApply holds when the update is not older than the last join and leave.
+const memberCanApply = `(chatmembers.last_join_time IS NULL OR EXCLUDED.last_action_time >= chatmembers.last_join_time)
+	AND (chatmembers.last_leave_time IS NULL OR EXCLUDED.last_action_time >= chatmembers.last_leave_time)`
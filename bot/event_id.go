@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"go-stats/database"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/gotd/td/tg"
+)
+
+// updateKey returns the natural key of an update from its pts, qts or
+// query ID, or "" if the update has none.
+func updateKey(update tg.UpdateClass) string {
+	if channelID, pts, _, ok, err := tg.IsChannelPtsUpdate(update); ok && err == nil && pts > 0 {
+		return fmt.Sprintf("pts:%d:%d", channelID, pts)
+	}
+	if pts, _, ok := tg.IsPtsUpdate(update); ok && pts > 0 {
+		return fmt.Sprintf("pts:%d", pts)
+	}
+	if qts, ok := tg.IsQtsUpdate(update); ok && qts > 0 {
+		return fmt.Sprintf("qts:%d", qts)
+	}
+
+	switch u := update.(type) {
+	case *tg.UpdateBotShippingQuery:
+		return fmt.Sprintf("query:%d", u.QueryID)
+	case *tg.UpdateBotPrecheckoutQuery:
+		return fmt.Sprintf("query:%d", u.QueryID)
+	case *tg.UpdateBotWebhookJSONQuery:
+		return fmt.Sprintf("query:%d", u.QueryID)
+	}
+	return ""
+}
+
+// eventID derives a deterministic ID of the event from the bot ID,
+// the update type and the natural key of the update, so the same update
+// delivered twice gets the same ID.
+//
+// Events without a natural key get a random ID and are never deduplicated.
+func eventID(event *database.Event, key string) uint64 {
+	if key == "" {
+		return rand.Uint64()
+	}
+
+	h := fnv.New64a()
+	var botID [8]byte
+	binary.LittleEndian.PutUint64(botID[:], uint64(event.BotID))
+	h.Write(botID[:])
+	h.Write([]byte(event.EventType))
+	h.Write([]byte{0})
+	h.Write([]byte(event.EventSubtype))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// eventDedup remembers the most recent event IDs.
+type eventDedup struct {
+	size  int
+	order *list.List
+	ids   map[uint64]*list.Element
+	mux   sync.Mutex
+}
+
+func newEventDedup(size int) *eventDedup {
+	return &eventDedup{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[uint64]*list.Element, size),
+	}
+}
+
+// has reports whether the ID was already seen without remembering it.
+func (d *eventDedup) has(id uint64) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	_, ok := d.ids[id]
+	return ok
+}
+
+// seen reports whether the ID was already seen and remembers it.
+func (d *eventDedup) seen(id uint64) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if el, ok := d.ids[id]; ok {
+		d.order.MoveToFront(el)
+		return true
+	}
+
+	d.ids[id] = d.order.PushFront(id)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.ids, oldest.Value.(uint64))
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/require"
+
+	"go-stats/database"
+)
+
+func TestUpdateKey(t *testing.T) {
+	for _, tt := range []struct {
+		update tg.UpdateClass
+		key    string
+	}{
+		{&tg.UpdateDeleteMessages{Pts: 10, PtsCount: 1}, "pts:10"},
+		{&tg.UpdateDeleteChannelMessages{ChannelID: 5, Pts: 11, PtsCount: 1}, "pts:5:11"},
+		{&tg.UpdateMessagePollVote{Qts: 12}, "qts:12"},
+		{&tg.UpdateBotPrecheckoutQuery{QueryID: 13}, "query:13"},
+		{&tg.UpdateBotShippingQuery{QueryID: 14}, "query:14"},
+		// Replayed messages don't carry pts
+		{&tg.UpdateNewChannelMessage{Message: &tg.MessageEmpty{}, Pts: -1}, ""},
+		{&tg.UpdateUser{UserID: 1}, ""},
+		{&tg.UpdateMessageReactions{Peer: &tg.PeerUser{UserID: 1}, MsgID: 1}, ""},
+	} {
+		require.Equal(t, tt.key, updateKey(tt.update), "%T", tt.update)
+	}
+
+	// Natural keys of the update types are kept
+	require.Equal(t, "query:15", handle(&tg.UpdateBotCallbackQuery{QueryID: 15, Peer: &tg.PeerUser{UserID: 1}}).key)
+	require.Equal(t, "pts:16", handle(&tg.UpdateDeleteMessages{Pts: 16, PtsCount: 1}).key)
+}
+
+func TestEventIDWithoutKey(t *testing.T) {
+	event := &database.Event{BotID: 1, EventType: "raw", EventSubtype: "User", UserID: 1}
+
+	// Updates without a key are not collapsed
+	require.NotEqual(t, eventID(event, ""), eventID(event, ""))
+	require.Equal(t, eventID(event, "pts:1"), eventID(event, "pts:1"))
+}
@@ -0,0 +1,102 @@
+package bot
+
+import "strconv"
+
+// FieldType is the type of a value stored in Event.Fields.
+// Values are stored as strings and parsed by the type.
+type FieldType string
+
+const (
+	FieldString FieldType = "string"
+	FieldInt    FieldType = "int"
+	FieldBool   FieldType = "bool"
+)
+
+// EventField declares a named field of an event payload.
+type EventField struct {
+	Name        string    `json:"name"`
+	Type        FieldType `json:"type"`
+	Description string    `json:"description"`
+}
+
+var (
+	fieldMessageID      = EventField{"message_id", FieldInt, "ID of the message"}
+	fieldMessageType    = EventField{"message_type", FieldString, "Message, MessageService or MessageEmpty"}
+	fieldMediaType      = EventField{"media_type", FieldString, "Media type, Text for text messages, action type for service messages"}
+	fieldPeerType       = EventField{"peer_type", FieldString, "Type of the chat peer"}
+	fieldFromType       = EventField{"from_type", FieldString, "Type of the sender peer"}
+	fieldViaBotID       = EventField{"via_bot_id", FieldInt, "ID of the inline bot the message was sent via"}
+	fieldEditHide       = EventField{"edit_hide", FieldBool, "Whether the edit date is hidden"}
+	fieldMentioned      = EventField{"mentioned", FieldBool, "Whether the bot is mentioned"}
+	fieldViews          = EventField{"views", FieldInt, "Number of views"}
+	fieldInlinePeerType = EventField{"inline_peer_type", FieldString, "Type of the chat the inline query was sent from"}
+	fieldOffset         = EventField{"offset", FieldString, "Offset of the inline results"}
+	fieldQueryLength    = EventField{"query_length", FieldInt, "Length of the query in characters"}
+	fieldGeo            = EventField{"geo", FieldBool, "Whether the user location is attached"}
+	fieldResultID       = EventField{"result_id", FieldString, "ID of the chosen inline result"}
+	fieldHasMsgID       = EventField{"has_msg_id", FieldBool, "Whether the sent inline message can be edited"}
+	fieldChatInstance   = EventField{"chat_instance", FieldInt, "Global identifier of the chat with the message"}
+	fieldGameName       = EventField{"game_name", FieldString, "Short name of the game"}
+	fieldWasMember      = EventField{"was_member", FieldBool, "Whether the user had a participant entry before the change"}
+	fieldIsMember       = EventField{"is_member", FieldBool, "Whether the user has a participant entry after the change"}
+	fieldViaChatlist    = EventField{"via_chatlist", FieldBool, "Whether the user joined via a chat folder link"}
+	fieldInviteHash     = EventField{"invite_hash", FieldString, "Invite link the user joined with"}
+	fieldStopped        = EventField{"stopped", FieldBool, "Whether the bot was stopped or restarted"}
+	fieldFromPts        = EventField{"from_pts", FieldInt, "Channel pts of the last update before the gap"}
+	fieldToPts          = EventField{"to_pts", FieldInt, "Channel pts the state was reset to"}
+	fieldLostUpdates    = EventField{"lost_updates", FieldInt, "Number of the lost channel updates"}
+	fieldGapFrom        = EventField{"gap_from", FieldInt, "Unix time of the last update before the gap, unset if unknown"}
+)
+
+var messageFields = []EventField{
+	fieldMessageID,
+	fieldMessageType,
+	fieldMediaType,
+	fieldPeerType,
+	fieldFromType,
+	fieldViaBotID,
+	fieldEditHide,
+	fieldMentioned,
+}
+
+// eventSchemas declares the fields of raw and gap events by event subtype.
+var eventSchemas = map[string][]EventField{
+	"NewMessage":          messageFields,
+	"NewChannelMessage":   messageFields,
+	"EditMessage":         messageFields,
+	"EditChannelMessage":  messageFields,
+	"ChannelMessageViews": {fieldMessageID, fieldViews},
+	"BotInlineQuery":      {fieldInlinePeerType, fieldOffset, fieldQueryLength, fieldGeo},
+	"BotInlineSend":       {fieldResultID, fieldQueryLength, fieldGeo, fieldHasMsgID},
+	"BotCallbackQuery":    {fieldChatInstance, fieldMessageID, fieldPeerType, fieldGameName},
+	"InlineBotCallbackQuery": {
+		fieldChatInstance,
+		fieldGameName,
+	},
+	"ChatParticipant":    {fieldWasMember, fieldIsMember, fieldInviteHash},
+	"ChannelParticipant": {fieldWasMember, fieldIsMember, fieldViaChatlist, fieldInviteHash},
+	"BotStopped":         {fieldStopped},
+
+	"ChannelDifferenceTooLong": {fieldFromPts, fieldToPts, fieldLostUpdates, fieldGapFrom},
+}
+
+// EventSchemas returns the declared fields of raw and gap events by event subtype.
+func EventSchemas() map[string][]EventField {
+	schemas := make(map[string][]EventField, len(eventSchemas))
+	for subtype, fields := range eventSchemas {
+		schemas[subtype] = append([]EventField(nil), fields...)
+	}
+	return schemas
+}
+
+func (i *ExtractedInfo) setString(f EventField, v string) {
+	i.fields[f.Name] = v
+}
+
+func (i *ExtractedInfo) setInt(f EventField, v int64) {
+	i.fields[f.Name] = strconv.FormatInt(v, 10)
+}
+
+func (i *ExtractedInfo) setBool(f EventField, v bool) {
+	i.fields[f.Name] = strconv.FormatBool(v)
+}
@@ -0,0 +1,287 @@
+package bot
+
+import (
+	"context"
+	"go-stats/database"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// LeaseConfig configures sharding of bots between instances.
+type LeaseConfig struct {
+	// Unique and stable ID of this instance
+	InstanceID string
+	// Time after which leases of a dead instance are taken over
+	TTL time.Duration
+}
+
+// leaseManager runs the bots leased by this instance.
+//
+// Every instance heartbeats and renews its leases each TTL/3. It takes
+// free or expired leases up to its fair share of the logged in bots and
+// releases the leases above the share, so bots move to a joining instance
+// and are taken over when an instance dies.
+type leaseManager struct {
+	pool *ConnectionPool
+	db   *gorm.DB
+	cfg  LeaseConfig
+	log  *zap.Logger
+	wake chan struct{}
+	// Set on shutdown, the leases are only renewed
+	draining atomic.Bool
+	// Closed to release the leases
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed when the leases are released
+	done chan struct{}
+}
+
+// ShardByLeases makes the pool run only the bots leased by this instance,
+// RunLeases has to be run to take the leases.
+func (c *ConnectionPool) ShardByLeases(cfg LeaseConfig) error {
+	if cfg.InstanceID == "" {
+		return errors.New("Instance ID is empty")
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 30 * time.Second
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.leases = &leaseManager{
+		pool: c,
+		db:   c.db,
+		cfg:  cfg,
+		log:  c.log.Named("leases"),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	return nil
+}
+
+// RunLeases runs the bots of this instance until the context is done
+// or the pool is shut down, then releases the leases.
+//
+// Shutdown releases the leases after the state of the bots is persisted,
+// so the context should outlive the shutdown.
+func (c *ConnectionPool) RunLeases(ctx context.Context) error {
+	c.mux.RLock()
+	m := c.leases
+	c.mux.RUnlock()
+	if m == nil {
+		return errors.New("Sharding is not enabled")
+	}
+	defer close(m.done)
+	defer m.releaseAll()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(m.cfg.TTL / 3)
+	defer ticker.Stop()
+	for {
+		if err := m.tick(ctx); err != nil {
+			m.log.Error("Failed to update leases", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// drain stops starting and stopping bots, the leases are kept until release.
+func (m *leaseManager) drain() {
+	m.draining.Store(true)
+}
+
+// releaseAndWait gives the leases up and waits until they are released.
+func (m *leaseManager) releaseAndWait(ctx context.Context) {
+	m.stopOnce.Do(func() { close(m.stop) })
+	m.wait(ctx)
+}
+
+// wait waits until the leases are released.
+func (m *leaseManager) wait(ctx context.Context) {
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+	}
+}
+
+func (m *leaseManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *leaseManager) tick(ctx context.Context) error {
+	db := m.db.WithContext(ctx)
+	ttl := m.cfg.TTL.Seconds()
+
+	if err := db.Exec(`
+		INSERT INTO instances (id, heartbeat_at) VALUES (?, now())
+		ON CONFLICT (id) DO UPDATE SET heartbeat_at = now()`,
+		m.cfg.InstanceID,
+	).Error; err != nil {
+		return errors.Wrap(err, "Failed to heartbeat")
+	}
+	if err := db.Exec(
+		"DELETE FROM instances WHERE heartbeat_at < now() - make_interval(secs => ?)",
+		10*ttl,
+	).Error; err != nil {
+		return errors.Wrap(err, "Failed to delete dead instances")
+	}
+
+	var members int64
+	if err := db.Model(&database.Instance{}).
+		Where("heartbeat_at > now() - make_interval(secs => ?)", ttl).
+		Count(&members).Error; err != nil {
+		return errors.Wrap(err, "Failed to count instances")
+	}
+	var loggedIn []int64
+	if err := db.Model(&database.Bot{}).Where("logged_in AND NOT removed").Order("id").Pluck("id", &loggedIn).Error; err != nil {
+		return errors.Wrap(err, "Failed to get bot IDs")
+	}
+	if members < 1 {
+		members = 1
+	}
+	share := (len(loggedIn) + int(members) - 1) / int(members)
+
+	// A lease which expired but was not taken over yet is kept,
+	// so a late heartbeat doesn't restart the bots
+	var owned []int64
+	if err := db.Raw(`
+		UPDATE botleases SET expires_at = now() + make_interval(secs => ?)
+		WHERE owner = ?
+		RETURNING bot_id`,
+		ttl, m.cfg.InstanceID,
+	).Scan(&owned).Error; err != nil {
+		return errors.Wrap(err, "Failed to renew leases")
+	}
+	if m.draining.Load() {
+		return nil
+	}
+
+	// Keep the leased bots which are still logged in, up to the share
+	active := make(map[int64]bool, len(loggedIn))
+	for _, botID := range loggedIn {
+		active[botID] = true
+	}
+	keep := make(map[int64]bool, len(owned))
+	for _, botID := range owned {
+		if active[botID] && len(keep) < share {
+			keep[botID] = true
+			continue
+		}
+		m.release(ctx, botID)
+	}
+
+	// Bots whose leases were taken over while this instance was away
+	for _, botID := range m.pool.botIDs() {
+		if !keep[botID] {
+			m.log.Warn("Lease lost, stopping bot", zap.Int64("bot", botID))
+			m.pool.replace(botID, nil)
+		}
+	}
+	for botID := range keep {
+		if !m.pool.HasBot(botID) {
+			m.start(botID)
+		}
+	}
+
+	if len(keep) >= share {
+		return nil
+	}
+	var free []int64
+	if err := db.Raw(`
+		SELECT b.id FROM bots b
+		LEFT JOIN botleases l ON l.bot_id = b.id
+		WHERE b.logged_in AND NOT b.removed AND (l.bot_id IS NULL OR l.expires_at < now())
+		ORDER BY b.id LIMIT ?`,
+		share-len(keep),
+	).Scan(&free).Error; err != nil {
+		return errors.Wrap(err, "Failed to get free bots")
+	}
+	for _, botID := range free {
+		acquired, err := m.acquire(ctx, botID)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			m.start(botID)
+		}
+	}
+	return nil
+}
+
+// acquire takes the free or expired lease of the bot. Returns false
+// if another instance holds the lease.
+func (m *leaseManager) acquire(ctx context.Context, botID int64) (bool, error) {
+	tx := m.db.WithContext(ctx).Exec(`
+		INSERT INTO botleases (bot_id, owner, expires_at)
+		VALUES (?, ?, now() + make_interval(secs => ?))
+		ON CONFLICT (bot_id) DO UPDATE
+		SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+		WHERE botleases.expires_at < now()`,
+		botID, m.cfg.InstanceID, m.cfg.TTL.Seconds(),
+	)
+	if tx.Error != nil {
+		return false, errors.Wrap(tx.Error, "Failed to acquire lease")
+	}
+	// Another instance was faster
+	return tx.RowsAffected > 0, nil
+}
+
+func (m *leaseManager) start(botID int64) {
+	m.log.Info("Starting leased bot", zap.Int64("bot", botID))
+	if err := m.pool.AddBot(botID); err != nil {
+		m.log.Error("Error starting bot", zap.Int64("bot", botID), zap.Error(err))
+		return
+	}
+	go func() {
+		if err := m.pool.RunBot(botID, false); err != nil {
+			m.log.Error("Error running bot", zap.Int64("bot", botID), zap.Error(err))
+		}
+	}()
+}
+
+// release stops the bot and gives its lease up.
+func (m *leaseManager) release(ctx context.Context, botID int64) {
+	m.log.Info("Releasing bot", zap.Int64("bot", botID))
+	m.pool.replace(botID, nil)
+	if err := m.db.WithContext(ctx).
+		Where("bot_id = ? AND owner = ?", botID, m.cfg.InstanceID).
+		Delete(&database.BotLease{}).Error; err != nil {
+		m.log.Error("Failed to release lease", zap.Int64("bot", botID), zap.Error(err))
+	}
+}
+
+// releaseAll gives all leases up so other instances take the bots at once.
+func (m *leaseManager) releaseAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := m.db.WithContext(ctx)
+	if err := db.Where("owner = ?", m.cfg.InstanceID).Delete(&database.BotLease{}).Error; err != nil {
+		m.log.Error("Failed to release leases", zap.Error(err))
+	}
+	if err := db.Delete(&database.Instance{ID: m.cfg.InstanceID}).Error; err != nil {
+		m.log.Error("Failed to remove instance", zap.Error(err))
+	}
+}
@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"go-stats/database"
+)
+
+// newTestLeases returns the lease manager of a new pool sharded
+// as the instance. Started bots stop right away.
+func newTestLeases(t *testing.T, db *gorm.DB, instanceID string) *leaseManager {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewConnectionPool(ctx, nil, nil, NewBoltSessions(newTestBolt(t)), 1, "hash", db, &testSink{}, DispatchConfig{}, zap.NewNop())
+	require.NoError(t, pool.ShardByLeases(LeaseConfig{InstanceID: instanceID, TTL: time.Hour}))
+	return pool.leases
+}
+
+// leaseOwners returns the owner of every lease by bot ID.
+func leaseOwners(t *testing.T, db *gorm.DB) map[int64]string {
+	t.Helper()
+
+	var leases []database.BotLease
+	require.NoError(t, db.Find(&leases).Error)
+	owners := make(map[int64]string, len(leases))
+	for _, l := range leases {
+		owners[l.BotID] = l.Owner
+	}
+	return owners
+}
+
+// countOwned returns the number of leases held by each instance.
+func countOwned(owners map[int64]string) map[string]int {
+	counts := map[string]int{}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	return counts
+}
+
+func TestLeasesFairShare(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	for botID := int64(1); botID <= 4; botID++ {
+		require.NoError(t, UpdateDb(db, &source, botID, &app, nil, true))
+	}
+	a := newTestLeases(t, db, "a")
+	b := newTestLeases(t, db, "b")
+
+	// The only instance takes every bot
+	require.NoError(t, a.tick(ctx))
+	require.Equal(t, map[string]int{"a": 4}, countOwned(leaseOwners(t, db)))
+	require.Len(t, a.pool.botIDs(), 4)
+
+	// The joining instance waits for the bots above the share of a
+	require.NoError(t, b.tick(ctx))
+	require.Equal(t, map[string]int{"a": 4}, countOwned(leaseOwners(t, db)))
+	require.Empty(t, b.pool.botIDs())
+
+	require.NoError(t, a.tick(ctx))
+	require.Equal(t, map[string]int{"a": 2}, countOwned(leaseOwners(t, db)))
+	require.Len(t, a.pool.botIDs(), 2)
+
+	require.NoError(t, b.tick(ctx))
+	owners := leaseOwners(t, db)
+	require.Equal(t, map[string]int{"a": 2, "b": 2}, countOwned(owners))
+	for _, botID := range b.pool.botIDs() {
+		require.Equal(t, "b", owners[botID])
+	}
+	for _, botID := range a.pool.botIDs() {
+		require.Equal(t, "a", owners[botID])
+	}
+}
+
+func TestLeasesTakeover(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	for botID := int64(1); botID <= 2; botID++ {
+		require.NoError(t, UpdateDb(db, &source, botID, &app, nil, true))
+	}
+	a := newTestLeases(t, db, "a")
+	b := newTestLeases(t, db, "b")
+
+	require.NoError(t, a.tick(ctx))
+	require.Equal(t, map[int64]string{1: "a", 2: "a"}, leaseOwners(t, db))
+
+	// a stops heartbeating and its leases expire
+	require.NoError(t, db.Exec("UPDATE instances SET heartbeat_at = now() - interval '2 hours' WHERE id = 'a'").Error)
+	require.NoError(t, db.Exec("UPDATE botleases SET expires_at = now() - interval '1 second'").Error)
+
+	require.NoError(t, b.tick(ctx))
+	require.Equal(t, map[int64]string{1: "b", 2: "b"}, leaseOwners(t, db))
+	require.ElementsMatch(t, []int64{1, 2}, b.pool.botIDs())
+
+	// The late heartbeat of a stops its bots instead of renewing the leases
+	require.NoError(t, a.tick(ctx))
+	require.Equal(t, map[int64]string{1: "b", 2: "b"}, leaseOwners(t, db))
+	require.Empty(t, a.pool.botIDs())
+}
+
+func TestLeasesRenewExpired(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	require.NoError(t, UpdateDb(db, &source, 1, &app, nil, true))
+	a := newTestLeases(t, db, "a")
+
+	require.NoError(t, a.tick(ctx))
+	require.NoError(t, db.Exec("UPDATE botleases SET expires_at = now() - interval '1 second'").Error)
+
+	// The expired lease was not taken over, so it is renewed and the bot keeps running
+	require.NoError(t, a.tick(ctx))
+	var lease database.BotLease
+	require.NoError(t, db.First(&lease, "bot_id = ?", 1).Error)
+	require.Equal(t, "a", lease.Owner)
+	require.True(t, lease.ExpiresAt.After(time.Now()))
+	require.True(t, a.pool.HasBot(1))
+}
+
+func TestLeasesLostRace(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	require.NoError(t, UpdateDb(db, &source, 1, &app, nil, true))
+	a := newTestLeases(t, db, "a")
+	b := newTestLeases(t, db, "b")
+
+	// Both instances saw the lease free, b took it first
+	acquired, err := b.acquire(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	acquired, err = a.acquire(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, acquired)
+	require.Equal(t, map[int64]string{1: "b"}, leaseOwners(t, db))
+
+	// The lease is taken once it expires
+	require.NoError(t, db.Exec("UPDATE botleases SET expires_at = now() - interval '1 second'").Error)
+	acquired, err = a.acquire(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	require.Equal(t, map[int64]string{1: "a"}, leaseOwners(t, db))
+}
@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dispatchMetrics aggregates what the dispatcher of a bot sees.
+type dispatchMetrics struct {
+	lastUpdate atomic.Int64
+	// Delay of the last dated update after it was sent, in nanoseconds
+	lag      atomic.Int64
+	timeouts atomic.Int64
+	inflight atomic.Int64
+	events   minuteCounter
+	// Channel gaps which could not be recovered
+	channelGaps atomic.Int64
+	lastGap     atomic.Int64
+}
+
+func (m *dispatchMetrics) updateReceived() {
+	m.lastUpdate.Store(time.Now().UnixNano())
+}
+
+// updateSent records the lag of the update sent at the date in unix seconds.
+func (m *dispatchMetrics) updateSent(date int) {
+	if date == 0 {
+		return
+	}
+	// The date has second precision
+	lag := time.Since(time.Unix(int64(date), 0))
+	if lag < 0 {
+		lag = 0
+	}
+	m.lag.Store(int64(lag))
+}
+
+// lastUpdateTime returns the time of the last update or nil if there was none.
+func (m *dispatchMetrics) lastUpdateTime() *time.Time {
+	nano := m.lastUpdate.Load()
+	if nano == 0 {
+		return nil
+	}
+	t := time.Unix(0, nano)
+	return &t
+}
+
+// lastGapTime returns the time of the last channel gap or nil if there was none.
+func (m *dispatchMetrics) lastGapTime() *time.Time {
+	nano := m.lastGap.Load()
+	if nano == 0 {
+		return nil
+	}
+	t := time.Unix(0, nano)
+	return &t
+}
+
+// minuteCounter counts per calendar minute.
+type minuteCounter struct {
+	mux      sync.Mutex
+	minute   int64
+	current  int64
+	previous int64
+}
+
+func (c *minuteCounter) rotate(now time.Time) {
+	minute := now.Unix() / 60
+	switch {
+	case minute == c.minute:
+	case minute == c.minute+1:
+		c.previous, c.current = c.current, 0
+	default:
+		c.previous, c.current = 0, 0
+	}
+	c.minute = minute
+}
+
+func (c *minuteCounter) add(n int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.rotate(time.Now())
+	c.current += n
+}
+
+// lastMinute returns the count of the last complete minute.
+func (c *minuteCounter) lastMinute() int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.rotate(time.Now())
+	return c.previous
+}
@@ -0,0 +1,37 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUpdateLag(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		source = "source"
+		app    = "app"
+	)
+	u := NewUpdateDispatcher(1, &source, &app, nil, &testSink{}, DispatchConfig{}, zap.NewNop())
+	defer u.stopWorkers()
+	bot := &TgBot{dispatcher: u}
+
+	// Updates without a date don't change the lag
+	require.NoError(t, u.Handle(ctx, &tg.UpdateShortSentMessage{}))
+	status := bot.Status()
+	require.NotNil(t, status.LastUpdateTime)
+	require.Zero(t, status.UpdateLag)
+
+	require.NoError(t, u.Handle(ctx, &tg.Updates{Date: int(time.Now().Add(-time.Minute).Unix())}))
+	status = bot.Status()
+	require.GreaterOrEqual(t, status.UpdateLag, 59.0)
+	require.Less(t, status.UpdateLag, 62.0)
+
+	// Clock skew doesn't make the lag negative
+	require.NoError(t, u.Handle(ctx, &tg.UpdateShort{Date: int(time.Now().Add(time.Minute).Unix())}))
+	require.Zero(t, bot.Status().UpdateLag)
+}
@@ -0,0 +1,212 @@
+package bot
+
+import (
+	"context"
+	"go-stats/database"
+	"go-stats/updates"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	_ updates.StateStorage = (*PostgresState)(nil)
+	_ updates.BatchStorage = (*PostgresState)(nil)
+)
+
+// PostgresState keeps the update state of the bots in Postgres,
+// so a bot can be moved to another host with its state.
+type PostgresState struct {
+	db *gorm.DB
+}
+
+func NewPostgresState(db *gorm.DB) *PostgresState {
+	return &PostgresState{db: db}
+}
+
+func (s *PostgresState) GetState(ctx context.Context, userID int64) (updates.State, bool, error) {
+	stored := database.UpdateState{BotID: userID}
+	err := s.db.WithContext(ctx).Where(&stored).First(&stored).Error
+	if err == gorm.ErrRecordNotFound {
+		return updates.State{}, false, nil
+	}
+	if err != nil {
+		return updates.State{}, false, errors.Wrap(err, "Failed to load state")
+	}
+	return updates.State{Pts: stored.Pts, Qts: stored.Qts, Date: stored.Date, Seq: stored.Seq}, true, nil
+}
+
+func (s *PostgresState) SetState(ctx context.Context, userID int64, state updates.State) error {
+	stored := database.UpdateState{BotID: userID, Pts: state.Pts, Qts: state.Qts, Date: state.Date, Seq: state.Seq}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bot_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pts", "qts", "date", "seq", "updated_at"}),
+	}).Create(&stored).Error
+	return errors.Wrap(err, "Failed to store state")
+}
+
+func (s *PostgresState) SetPts(ctx context.Context, userID int64, pts int) error {
+	return s.updateState(ctx, userID, map[string]any{"pts": pts})
+}
+
+func (s *PostgresState) SetQts(ctx context.Context, userID int64, qts int) error {
+	return s.updateState(ctx, userID, map[string]any{"qts": qts})
+}
+
+func (s *PostgresState) SetDate(ctx context.Context, userID int64, date int) error {
+	return s.updateState(ctx, userID, map[string]any{"date": date})
+}
+
+func (s *PostgresState) SetSeq(ctx context.Context, userID int64, seq int) error {
+	return s.updateState(ctx, userID, map[string]any{"seq": seq})
+}
+
+func (s *PostgresState) SetDateSeq(ctx context.Context, userID int64, date, seq int) error {
+	return s.updateState(ctx, userID, map[string]any{"date": date, "seq": seq})
+}
+
+// updateState updates the columns of the existing state.
+func (s *PostgresState) updateState(ctx context.Context, userID int64, columns map[string]any) error {
+	tx := s.db.WithContext(ctx).Model(&database.UpdateState{}).Where("bot_id = ?", userID).Updates(columns)
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "Failed to update state")
+	}
+	if tx.RowsAffected == 0 {
+		return ErrStateNotFound
+	}
+	return nil
+}
+
+func (s *PostgresState) GetChannelPts(ctx context.Context, userID, channelID int64) (int, bool, error) {
+	var stored database.ChannelState
+	err := s.db.WithContext(ctx).
+		Where("bot_id = ? AND channel_id = ? AND pts IS NOT NULL", userID, channelID).
+		First(&stored).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "Failed to load channel pts")
+	}
+	return *stored.Pts, true, nil
+}
+
+func (s *PostgresState) SetChannelPts(ctx context.Context, userID, channelID int64, pts int) error {
+	stored := database.ChannelState{BotID: userID, ChannelID: channelID, Pts: &pts}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bot_id"}, {Name: "channel_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pts"}),
+	}).Create(&stored).Error
+	return errors.Wrap(err, "Failed to store channel pts")
+}
+
+// SetBatch writes the states and channel pts in one transaction.
+func (s *PostgresState) SetBatch(ctx context.Context, batch updates.StateBatch) error {
+	states := make([]database.UpdateState, 0, len(batch.States))
+	for userID, state := range batch.States {
+		states = append(states, database.UpdateState{BotID: userID, Pts: state.Pts, Qts: state.Qts, Date: state.Date, Seq: state.Seq})
+	}
+	var channels []database.ChannelState
+	for userID, pts := range batch.Channels {
+		for channelID, v := range pts {
+			v := v
+			channels = append(channels, database.ChannelState{BotID: userID, ChannelID: channelID, Pts: &v})
+		}
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(states) > 0 {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "bot_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"pts", "qts", "date", "seq", "updated_at"}),
+			}).CreateInBatches(&states, 1000).Error; err != nil {
+				return err
+			}
+		}
+		if len(channels) > 0 {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "bot_id"}, {Name: "channel_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"pts"}),
+			}).CreateInBatches(&channels, 1000).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "Failed to store state batch")
+}
+
+// DeleteChannelPts forgets the channel state, the access hash is kept.
+func (s *PostgresState) DeleteChannelPts(ctx context.Context, userID, channelID int64) error {
+	err := s.db.WithContext(ctx).Model(&database.ChannelState{}).
+		Where("bot_id = ? AND channel_id = ?", userID, channelID).
+		Update("pts", nil).Error
+	return errors.Wrap(err, "Failed to delete channel pts")
+}
+
+func (s *PostgresState) ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
+	var channels []database.ChannelState
+	if err := s.db.WithContext(ctx).
+		Where("bot_id = ? AND pts IS NOT NULL", userID).
+		Find(&channels).Error; err != nil {
+		return errors.Wrap(err, "Failed to load channels")
+	}
+
+	for _, c := range channels {
+		if err := f(ctx, c.ChannelID, *c.Pts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	_ updates.ChannelAccessHasher      = (*PostgresAccessHasher)(nil)
+	_ updates.ChannelAccessHashBatcher = (*PostgresAccessHasher)(nil)
+)
+
+// PostgresAccessHasher keeps the channel access hashes next to the channel state.
+type PostgresAccessHasher struct {
+	db *gorm.DB
+}
+
+func NewPostgresAccessHasher(db *gorm.DB) *PostgresAccessHasher {
+	return &PostgresAccessHasher{db: db}
+}
+
+func (s *PostgresAccessHasher) GetChannelAccessHash(ctx context.Context, userID, channelID int64) (int64, bool, error) {
+	var stored database.ChannelState
+	err := s.db.WithContext(ctx).
+		Where("bot_id = ? AND channel_id = ? AND access_hash IS NOT NULL", userID, channelID).
+		First(&stored).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "Failed to load access hash")
+	}
+	return *stored.AccessHash, true, nil
+}
+
+func (s *PostgresAccessHasher) SetChannelAccessHash(ctx context.Context, userID, channelID, accessHash int64) error {
+	return s.SetChannelAccessHashes(ctx, userID, map[int64]int64{channelID: accessHash})
+}
+
+// SetChannelAccessHashes stores the hashes in batches of 1000 channels.
+func (s *PostgresAccessHasher) SetChannelAccessHashes(ctx context.Context, userID int64, hashes map[int64]int64) error {
+	rows := make([]database.ChannelState, 0, len(hashes))
+	for channelID, hash := range hashes {
+		hash := hash
+		rows = append(rows, database.ChannelState{BotID: userID, ChannelID: channelID, AccessHash: &hash})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bot_id"}, {Name: "channel_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"access_hash"}),
+	}).CreateInBatches(&rows, 1000).Error
+	return errors.Wrap(err, "Failed to store access hashes")
+}
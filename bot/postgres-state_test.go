@@ -0,0 +1,160 @@
+package bot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go-stats/updates"
+)
+
+func TestPostgresState(t *testing.T) {
+	ctx := context.Background()
+	s := NewPostgresState(newTestPostgres(t))
+
+	_, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, found)
+	// No row is updated before the state is set
+	require.ErrorIs(t, s.SetPts(ctx, 1, 10), ErrStateNotFound)
+	require.ErrorIs(t, s.SetDateSeq(ctx, 1, 30, 40), ErrStateNotFound)
+
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}))
+	require.NoError(t, s.SetPts(ctx, 1, 10))
+	require.NoError(t, s.SetQts(ctx, 1, 20))
+	require.NoError(t, s.SetDateSeq(ctx, 1, 30, 40))
+
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 10, Qts: 20, Date: 30, Seq: 40}, state)
+
+	// Setting the state again overwrites it
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}))
+	state, found, err = s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}, state)
+
+	// Bots don't share the state
+	_, found, err = s.GetState(ctx, 2)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.ErrorIs(t, s.SetSeq(ctx, 2, 1), ErrStateNotFound)
+}
+
+func TestPostgresStateChannels(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	s := NewPostgresState(db)
+	hasher := NewPostgresAccessHasher(db)
+
+	_, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+	require.NoError(t, s.SetChannelPts(ctx, 1, -100, 6))
+	require.NoError(t, s.SetChannelPts(ctx, 2, 100, 7))
+	require.NoError(t, hasher.SetChannelAccessHash(ctx, 1, 100, 42))
+
+	pts, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, pts)
+
+	// The storage can be used while iterating
+	channels := map[int64]int{}
+	require.NoError(t, s.ForEachChannels(ctx, 1, func(ctx context.Context, channelID int64, pts int) error {
+		channels[channelID] = pts
+		return s.SetChannelPts(ctx, 1, channelID, pts+1)
+	}))
+	require.Equal(t, map[int64]int{100: 5, -100: 6}, channels)
+
+	// The pts is nulled, the access hash of the channel is kept
+	require.NoError(t, s.DeleteChannelPts(ctx, 1, 100))
+	_, found, err = s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+	hash, found, err := hasher.GetChannelAccessHash(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(42), hash)
+
+	// Deleted channels are skipped
+	channels = map[int64]int{}
+	require.NoError(t, s.ForEachChannels(ctx, 1, func(ctx context.Context, channelID int64, pts int) error {
+		channels[channelID] = pts
+		return nil
+	}))
+	require.Equal(t, map[int64]int{-100: 7}, channels)
+
+	pts, found, err = s.GetChannelPts(ctx, 2, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 7, pts)
+}
+
+func TestPostgresStateBatch(t *testing.T) {
+	ctx := context.Background()
+	s := NewPostgresState(newTestPostgres(t))
+
+	require.NoError(t, s.SetState(ctx, 1, updates.State{Pts: 1}))
+	require.NoError(t, s.SetBatch(ctx, updates.StateBatch{
+		States:   map[int64]updates.State{1: {Pts: 1, Qts: 2, Date: 3, Seq: 4}},
+		Channels: map[int64]map[int64]int{1: {100: 5}, 2: {100: 6}},
+	}))
+	require.NoError(t, s.SetBatch(ctx, updates.StateBatch{}))
+
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, updates.State{Pts: 1, Qts: 2, Date: 3, Seq: 4}, state)
+
+	pts, found, err := s.GetChannelPts(ctx, 2, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 6, pts)
+}
+
+func TestPostgresAccessHasher(t *testing.T) {
+	ctx := context.Background()
+	db := newTestPostgres(t)
+	s := NewPostgresState(db)
+	hasher := NewPostgresAccessHasher(db)
+
+	_, found, err := hasher.GetChannelAccessHash(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, hasher.SetChannelAccessHashes(ctx, 1, nil))
+	require.NoError(t, hasher.SetChannelAccessHashes(ctx, 1, map[int64]int64{100: 1, 101: 2}))
+	require.NoError(t, hasher.SetChannelAccessHash(ctx, 1, 100, 3))
+
+	hash, found, err := hasher.GetChannelAccessHash(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(3), hash)
+	hash, found, err = hasher.GetChannelAccessHash(ctx, 1, 101)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(2), hash)
+
+	// A channel with a hash only has no pts
+	_, found, err = s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// The pts doesn't change the hash
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+	hash, found, err = hasher.GetChannelAccessHash(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(3), hash)
+
+	// Bots don't share the hashes
+	_, found, err = hasher.GetChannelAccessHash(ctx, 2, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+}
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"context"
+	"go-stats/database"
+
+	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SessionStore gives the session storage of every bot.
+type SessionStore interface {
+	Storage(botID int64) telegram.SessionStorage
+	// Delete removes the session, the bot has to log in again.
+	Delete(botID int64) error
+}
+
+// BoltSessions keeps sessions in the local bbolt database.
+type BoltSessions struct {
+	db *bolt.DB
+}
+
+func NewBoltSessions(db *bolt.DB) BoltSessions {
+	return BoltSessions{db: db}
+}
+
+func (s BoltSessions) Storage(botID int64) telegram.SessionStorage {
+	return NewBoltSessionStorage(s.db, botID)
+}
+
+func (s BoltSessions) Delete(botID int64) error {
+	return DeleteBoltSession(s.db, botID)
+}
+
+// PostgresSessions keeps sessions in Postgres so any instance can run a bot.
+//
+// Sessions missing in Postgres are copied from the bbolt database if it is set,
+// bots logged in before the switch keep their sessions.
+type PostgresSessions struct {
+	db       *gorm.DB
+	fallback *bolt.DB
+}
+
+func NewPostgresSessions(db *gorm.DB, fallback *bolt.DB) PostgresSessions {
+	return PostgresSessions{db: db, fallback: fallback}
+}
+
+func (s PostgresSessions) Storage(botID int64) telegram.SessionStorage {
+	storage := &PostgresSessionStorage{db: s.db, botID: botID}
+	if s.fallback != nil {
+		storage.fallback = NewBoltSessionStorage(s.fallback, botID)
+	}
+	return storage
+}
+
+func (s PostgresSessions) Delete(botID int64) error {
+	if err := s.db.Delete(&database.Session{BotID: botID}).Error; err != nil {
+		return errors.Wrap(err, "Failed to delete session")
+	}
+	if s.fallback != nil {
+		return DeleteBoltSession(s.fallback, botID)
+	}
+	return nil
+}
+
+// PostgresSessionStorage implements telegram.SessionStorage for a bot.
+type PostgresSessionStorage struct {
+	db       *gorm.DB
+	botID    int64
+	fallback telegram.SessionStorage
+}
+
+func (s *PostgresSessionStorage) LoadSession(ctx context.Context) ([]byte, error) {
+	stored := database.Session{BotID: s.botID}
+	err := s.db.WithContext(ctx).Where(&stored).First(&stored).Error
+	if err == nil {
+		return stored.Data, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, errors.Wrap(err, "Failed to load session")
+	}
+	if s.fallback == nil {
+		return nil, session.ErrNotFound
+	}
+
+	data, err := s.fallback.LoadSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.StoreSession(ctx, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *PostgresSessionStorage) StoreSession(ctx context.Context, data []byte) error {
+	stored := database.Session{BotID: s.botID, Data: data}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bot_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+	}).Create(&stored).Error
+	return errors.Wrap(err, "Failed to store session")
+}
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"go-stats/database"
+)
+
+// newTestPostgres connects to TEST_POSTGRES_DSN, tests using Postgres
+// are skipped without it. Every test gets its own schema.
+func newTestPostgres(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	config := &gorm.Config{
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+	}
+
+	admin, err := gorm.Open(postgres.Open(dsn), config)
+	require.NoError(t, err)
+	schema := fmt.Sprintf("test_%d", rand.Uint32())
+	require.NoError(t, admin.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() {
+		_ = admin.Exec("DROP SCHEMA " + schema + " CASCADE").Error
+		if db, err := admin.DB(); err == nil {
+			_ = db.Close()
+		}
+	})
+
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := gorm.Open(postgres.Open(dsn), config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if db, err := db.DB(); err == nil {
+			_ = db.Close()
+		}
+	})
+
+	require.NoError(t, db.AutoMigrate(
+		&database.Bot{}, &database.Chat{}, &database.Instance{}, &database.BotLease{},
+		&database.UpdateState{}, &database.ChannelState{},
+	))
+	return db
+}
@@ -0,0 +1,128 @@
+package bot
+
+import (
+	"context"
+	"go-stats/database"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ReconcileConfig configures reloading of the bot set.
+type ReconcileConfig struct {
+	// Postgres DSN used to LISTEN for changes of the bots table
+	DSN string
+	// Interval of polling in case notifications are lost
+	Interval time.Duration
+}
+
+// Reconcile keeps the pool in line with the logged in bots in Postgres
+// until the context is done: new bots are started and bots logged out,
+// deleted or removed through the API are stopped. Bots stopped through
+// the API are left stopped.
+//
+// Changes are picked up from notifications on database.BotsChannel and by
+// polling. When bots are sharded the leases decide which bots run here,
+// changes only trigger their update.
+func (c *ConnectionPool) Reconcile(ctx context.Context, cfg ReconcileConfig) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	log := c.log.Named("reconciler")
+	wake := make(chan struct{}, 1)
+	if cfg.DSN != "" {
+		go c.listenBots(ctx, cfg, wake, log)
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.reconcile(ctx); err != nil {
+			log.Error("Failed to reconcile bots", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+func (c *ConnectionPool) reconcile(ctx context.Context) error {
+	c.mux.RLock()
+	leases := c.leases
+	c.mux.RUnlock()
+	if leases != nil {
+		leases.notify()
+		return nil
+	}
+
+	var loggedIn []int64
+	if err := c.db.WithContext(ctx).Model(&database.Bot{}).Where("logged_in AND NOT removed").Pluck("id", &loggedIn).Error; err != nil {
+		return errors.Wrap(err, "Failed to get bot IDs")
+	}
+
+	active := make(map[int64]bool, len(loggedIn))
+	for _, botID := range loggedIn {
+		active[botID] = true
+		if c.HasBot(botID) {
+			continue
+		}
+		if err := c.StartBot(botID, false); err != nil {
+			c.log.Error("Error starting bot", zap.Int64("bot", botID), zap.Error(err))
+		}
+		time.Sleep(time.Millisecond * 3)
+	}
+	for _, botID := range c.botIDs() {
+		if !active[botID] {
+			c.log.Info("Bot logged out, removing", zap.Int64("bot", botID))
+			c.replace(botID, nil)
+		}
+	}
+	return nil
+}
+
+// listenBots wakes the reconciler on notifications, reconnecting on errors.
+func (c *ConnectionPool) listenBots(ctx context.Context, cfg ReconcileConfig, wake chan<- struct{}, log *zap.Logger) {
+	for {
+		err := listen(ctx, cfg.DSN, database.BotsChannel, func() {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn("Listening for bot changes failed, polling only", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+func listen(ctx context.Context, dsn, channel string, notify func()) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return errors.Wrap(err, "Failed to connect")
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return errors.Wrap(err, "Failed to listen")
+	}
+	// Changes made while not listening
+	notify()
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return errors.Wrap(err, "Failed to wait for notification")
+		}
+		notify()
+	}
+}
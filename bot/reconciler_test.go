@@ -0,0 +1,36 @@
+package bot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReconcileRemovedBot(t *testing.T) {
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	require.NoError(t, UpdateDb(db, &source, 1, &app, nil, true))
+
+	// Started bots stop right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewConnectionPool(ctx, nil, nil, NewBoltSessions(newTestBolt(t)), 1, "hash", db, &testSink{}, DispatchConfig{}, zap.NewNop())
+
+	require.NoError(t, pool.reconcile(context.Background()))
+	require.True(t, pool.HasBot(1))
+
+	require.NoError(t, pool.RemoveBot(1))
+	require.False(t, pool.HasBot(1))
+	require.Error(t, pool.RemoveBot(2))
+
+	// The bot is still logged in but stays removed
+	require.NoError(t, pool.reconcile(context.Background()))
+	require.False(t, pool.HasBot(1))
+
+	// Until it is added again
+	require.NoError(t, UpdateDb(db, &source, 1, &app, nil, true))
+	require.NoError(t, pool.reconcile(context.Background()))
+	require.True(t, pool.HasBot(1))
+}
@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// ShutdownReport tells what was lost on shutdown.
+type ShutdownReport struct {
+	Bots int
+	// Updates which were still dispatched at the deadline
+	AbandonedUpdates int64
+	// Bots whose update state was not persisted
+	StateErrors int
+}
+
+// Shutdown stops all bots, waits for the updates being dispatched until
+// the context is done and persists the update state of the bots. Leases
+// are released after that, so the next owner starts from the saved state.
+//
+// The event sink has to be flushed after it returns.
+func (c *ConnectionPool) Shutdown(ctx context.Context) ShutdownReport {
+	c.mux.Lock()
+	if c.leases != nil {
+		// No bots are taken while shutting down
+		c.leases.drain()
+	}
+	bots := make([]*TgBot, 0, len(c.bots))
+	for _, bot := range c.bots {
+		bots = append(bots, bot)
+	}
+	leases := c.leases
+	c.mux.Unlock()
+
+	report := ShutdownReport{Bots: len(bots)}
+	var (
+		wg          sync.WaitGroup
+		abandoned   atomic.Int64
+		stateErrors atomic.Int64
+	)
+	for _, bot := range bots {
+		wg.Add(1)
+		go func(bot *TgBot) {
+			defer wg.Done()
+
+			// No new updates are accepted once the client is stopped
+			bot.Stop()
+			abandoned.Add(bot.dispatcher.wait(ctx))
+			bot.dispatcher.stopWorkers()
+			if err := bot.Flush(ctx); err != nil {
+				bot.namedLog.Error("Failed to persist update state", zap.Error(err))
+				stateErrors.Add(1)
+			}
+		}(bot)
+	}
+	wg.Wait()
+
+	if leases != nil {
+		leases.releaseAndWait(ctx)
+	}
+
+	report.AbandonedUpdates = abandoned.Load()
+	report.StateErrors = int(stateErrors.Load())
+	return report
+}
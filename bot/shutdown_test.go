@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go-stats/database"
+)
+
+// flushHook calls flush when the state is persisted.
+type flushHook struct {
+	*BoltState
+	flush func()
+}
+
+func (f flushHook) Flush(ctx context.Context) error {
+	f.flush()
+	return nil
+}
+
+func TestShutdownReleasesLeasesAfterFlush(t *testing.T) {
+	db := newTestPostgres(t)
+	source, app := "source", "app"
+	require.NoError(t, UpdateDb(db, &source, 1, &app, nil, true))
+
+	leases := func() (n int64) {
+		require.NoError(t, db.Model(&database.BotLease{}).Where("owner = ?", "a").Count(&n).Error)
+		return n
+	}
+	var leasedOnFlush int64
+	state := flushHook{
+		BoltState: NewBoltState(newTestBolt(t)),
+		flush:     func() { leasedOnFlush = leases() },
+	}
+
+	// Started bots stop right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewConnectionPool(ctx, state, nil, NewBoltSessions(newTestBolt(t)), 1, "hash", db, &testSink{}, DispatchConfig{}, zap.NewNop())
+	require.NoError(t, pool.ShardByLeases(LeaseConfig{InstanceID: "a", TTL: time.Hour}))
+	go func() { _ = pool.RunLeases(context.Background()) }()
+
+	require.Eventually(t, func() bool { return pool.HasBot(1) }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), leases())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	report := pool.Shutdown(shutdownCtx)
+	require.Equal(t, 1, report.Bots)
+	require.Zero(t, report.StateErrors)
+
+	// The lease is held while the state is persisted
+	require.Equal(t, int64(1), leasedOnFlush)
+	require.Zero(t, leases())
+}
@@ -0,0 +1,144 @@
+package bot
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/gotd/td/telegram/auth"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = 5 * time.Minute
+	// A run longer than this resets the restart delay
+	stableRunTime = time.Minute
+)
+
+// BotState is the state of a supervised bot.
+type BotState string
+
+const (
+	StateRunning      BotState = "running"
+	StateBackingOff   BotState = "backing_off"
+	StateStopped      BotState = "stopped"
+	StateUnauthorized BotState = "unauthorized"
+)
+
+// BotStatus is the state of the bot with its last error.
+type BotStatus struct {
+	BotID         int64      `json:"bot_id"`
+	State         BotState   `json:"state"`
+	Since         time.Time  `json:"since"`
+	Restarts      int        `json:"restarts"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	LastUpdateTime *time.Time `json:"last_update_time,omitempty"`
+	// Seconds between sending and receiving the last dated update
+	UpdateLag        float64 `json:"update_lag"`
+	EventsPerMinute  int64   `json:"events_per_minute"`
+	DispatchTimeouts int64   `json:"dispatch_timeouts"`
+	// Channel gaps which could not be recovered since the start
+	ChannelGaps    int64      `json:"channel_gaps"`
+	LastChannelGap *time.Time `json:"last_channel_gap,omitempty"`
+}
+
+// isFatal reports whether restarting the bot can not help.
+func isFatal(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || auth.IsUnauthorized(err)
+}
+
+// restartDelay returns the exponential backoff delay with jitter
+// before the restart after the given number of failures.
+func restartDelay(failures int) time.Duration {
+	delay := minRestartDelay
+	for i := 1; i < failures && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	// Spread restarts of bots which failed together
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// supervise runs the bot, restarting it on transient errors
+// until the context is done or a fatal error occurs.
+func (b *TgBot) supervise(ctx context.Context, forget bool) error {
+	failures := 0
+	for {
+		started := time.Now()
+		err := b.runOnce(ctx, forget)
+		// The state is kept on restarts
+		forget = false
+
+		if ctx.Err() != nil {
+			b.setState(StateStopped, nil)
+			return nil
+		}
+		if isFatal(err) {
+			b.namedLog.Error("Bot unauthorized, not restarting", zap.Error(err))
+			b.setState(StateUnauthorized, err)
+			return err
+		}
+		if err == nil {
+			err = errors.New("Bot stopped unexpectedly")
+		}
+
+		if time.Since(started) > stableRunTime {
+			failures = 0
+		}
+		failures++
+		delay := restartDelay(failures)
+		b.namedLog.Warn("Bot failed, restarting", zap.Error(err), zap.Duration("delay", delay))
+		b.setState(StateBackingOff, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			b.setState(StateStopped, nil)
+			return nil
+		case <-timer.C:
+		}
+
+		b.mux.Lock()
+		b.status.Restarts++
+		b.mux.Unlock()
+	}
+}
+
+func (b *TgBot) setState(state BotState, err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.status.State != state {
+		b.status.State = state
+		b.status.Since = time.Now()
+	}
+	if err != nil {
+		now := time.Now()
+		b.status.LastError = err.Error()
+		b.status.LastErrorTime = &now
+	}
+}
+
+// Status returns the state of the bot and its dispatch metrics.
+func (b *TgBot) Status() BotStatus {
+	b.mux.Lock()
+	status := b.status
+	b.mux.Unlock()
+
+	metrics := b.dispatcher.metrics
+	status.BotID = b.botID
+	status.LastUpdateTime = metrics.lastUpdateTime()
+	status.UpdateLag = time.Duration(metrics.lag.Load()).Seconds()
+	status.EventsPerMinute = metrics.events.lastMinute()
+	status.DispatchTimeouts = metrics.timeouts.Load()
+	status.ChannelGaps = metrics.channelGaps.Load()
+	status.LastChannelGap = metrics.lastGapTime()
+	return status
+}
@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"fmt"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -19,8 +20,11 @@ type ExtractedInfo struct {
 	dataLowCardinality []string
 	dataInt            []int64
 	dataFlags          []bool
+	fields             map[string]string
 	referer            string
 	timestamp          time.Time
+	// Natural key of the update, used to derive the event ID.
+	key string
 }
 
 func getPeerID(peer tg.PeerClass) int64 {
@@ -51,14 +55,20 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 	switch m := message.(type) {
 	case *tg.MessageEmpty:
 		info.dataInt[0] = int64(m.GetID())
+		info.setInt(fieldMessageID, int64(m.GetID()))
 		peerID, ok := m.GetPeerID()
 		info.dataLowCardinality[0] = "MessageEmpty"
 		info.dataLowCardinality[1] = "Empty"
+		info.setString(fieldMessageType, "MessageEmpty")
+		info.setString(fieldMediaType, "Empty")
 		if ok {
 			info.chatID = getPeerID(peerID)
 			info.dataLowCardinality[2] = peerID.TypeName()
 			info.dataLowCardinality[3] = peerID.TypeName()
+			info.setString(fieldPeerType, peerID.TypeName())
+			info.setString(fieldFromType, peerID.TypeName())
 		}
+		info.key = fmt.Sprintf("msg:%d:%d", info.chatID, m.GetID())
 		if !ok || peerID.TypeID() == tg.PeerChannelTypeID {
 			info.ignoreUpdate = true
 		}
@@ -68,15 +78,19 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 		info.updateSession = !info.fromBot
 
 		info.dataInt[0] = int64(m.GetID())
+		info.setInt(fieldMessageID, int64(m.GetID()))
 		// info.dataInt = append(info.dataInt, viaBot)
 
 		info.dataFlags[0] = false
 		info.dataFlags[1] = m.GetMentioned()
+		info.setBool(fieldMentioned, m.GetMentioned())
 
 		info.timestamp = time.Unix(int64(m.GetDate()), 0)
 
 		info.dataLowCardinality[0] = "MessageService"
 		info.dataLowCardinality[1] = m.Action.TypeName()
+		info.setString(fieldMessageType, "MessageService")
+		info.setString(fieldMediaType, m.Action.TypeName())
 
 		peer := m.GetPeerID()
 		from, okFrom := m.GetFromID()
@@ -92,6 +106,9 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 			info.dataLowCardinality[2] = peer.TypeName()
 			info.dataLowCardinality[3] = peer.TypeName()
 		}
+		info.setString(fieldPeerType, info.dataLowCardinality[2])
+		info.setString(fieldFromType, info.dataLowCardinality[3])
+		info.key = fmt.Sprintf("msg:%d:%d", info.chatID, m.GetID())
 
 		return info
 	case *tg.Message:
@@ -99,13 +116,17 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 		info.updateSession = !info.fromBot
 
 		info.dataInt[0] = int64(m.GetID())
+		info.setInt(fieldMessageID, int64(m.GetID()))
 		viaBot, okViaBot := m.GetViaBotID()
 		if okViaBot {
 			info.dataInt[1] = viaBot
+			info.setInt(fieldViaBotID, viaBot)
 		}
 
 		info.dataFlags[0] = m.GetEditHide()
 		info.dataFlags[1] = m.GetMentioned()
+		info.setBool(fieldEditHide, m.GetEditHide())
+		info.setBool(fieldMentioned, m.GetMentioned())
 
 		editDate, okEditDate := m.GetEditDate()
 		if okEditDate {
@@ -115,12 +136,14 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 		}
 
 		info.dataLowCardinality[0] = "Message"
+		info.setString(fieldMessageType, "Message")
 		media, okMedia := m.GetMedia()
 		if okMedia {
 			info.dataLowCardinality[1] = media.TypeName()
 		} else {
 			info.dataLowCardinality[1] = "Text"
 		}
+		info.setString(fieldMediaType, info.dataLowCardinality[1])
 
 		peer := m.GetPeerID()
 		from, okFrom := m.GetFromID()
@@ -136,6 +159,10 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 			info.dataLowCardinality[2] = peer.TypeName()
 			info.dataLowCardinality[3] = peer.TypeName()
 		}
+		info.setString(fieldPeerType, info.dataLowCardinality[2])
+		info.setString(fieldFromType, info.dataLowCardinality[3])
+		// Every edit is a separate event
+		info.key = fmt.Sprintf("msg:%d:%d:%d", info.chatID, m.GetID(), editDate)
 
 		if !m.Out && !m.Post && !okViaBot && !m.Mentioned && m.PeerID.TypeID() == tg.PeerChannelTypeID {
 			info.ignoreUpdate = true
@@ -168,6 +195,14 @@ func dataFromMessage(message tg.MessageClass, info *ExtractedInfo) *ExtractedInf
 }
 
 func handle(update tg.UpdateClass) *ExtractedInfo {
+	info := extractInfo(update)
+	if info.key == "" {
+		info.key = updateKey(update)
+	}
+	return info
+}
+
+func extractInfo(update tg.UpdateClass) *ExtractedInfo {
 	info := ExtractedInfo{
 		ignoreUpdate:       false,
 		fromBot:            false,
@@ -181,6 +216,7 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		dataFlags:          []bool{},
 		referer:            "",
 		timestamp:          time.Now(),
+		fields:             map[string]string{},
 	}
 
 	switch u := update.(type) {
@@ -223,6 +259,9 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		info.chatID = u.ChannelID
 		info.dataInt = append(info.dataInt, int64(u.ID))
 		info.dataInt = append(info.dataInt, int64(u.Views))
+		info.setInt(fieldMessageID, int64(u.ID))
+		info.setInt(fieldViews, int64(u.Views))
+		info.key = fmt.Sprintf("views:%d:%d:%d", u.ChannelID, u.ID, u.Views)
 		return &info
 	case *tg.UpdateChatParticipantAdmin:
 	case *tg.UpdateNewStickerSet:
@@ -230,6 +269,7 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 	case *tg.UpdateStickerSets:
 	case *tg.UpdateSavedGifs:
 	case *tg.UpdateBotInlineQuery:
+		info.key = fmt.Sprintf("query:%d", u.QueryID)
 		info.userID = u.UserID
 		info.fromBot = false
 		info.updateSession = true
@@ -258,8 +298,13 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		info.dataInt = append(info.dataInt, int64(utf8.RuneCountInString(u.Query)))
 		_, okGeo := u.GetGeo()
 		info.dataFlags = append(info.dataFlags, okGeo)
+		info.setString(fieldInlinePeerType, inlineChatType)
+		info.setString(fieldOffset, u.Offset)
+		info.setInt(fieldQueryLength, int64(utf8.RuneCountInString(u.Query)))
+		info.setBool(fieldGeo, okGeo)
 		return &info
 	case *tg.UpdateBotInlineSend:
+		info.key = fmt.Sprintf("inline:%d:%s:%s", u.UserID, u.ID, u.Query)
 		info.userID = u.UserID
 		info.fromBot = true
 		info.updateSession = true
@@ -269,10 +314,15 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		_, okMsgID := u.GetMsgID()
 		info.dataFlags = append(info.dataFlags, okGeo)
 		info.dataFlags = append(info.dataFlags, okMsgID)
+		info.setString(fieldResultID, u.ID)
+		info.setInt(fieldQueryLength, int64(utf8.RuneCountInString(u.Query)))
+		info.setBool(fieldGeo, okGeo)
+		info.setBool(fieldHasMsgID, okMsgID)
 		return &info
 	case *tg.UpdateEditChannelMessage:
 		return dataFromMessage(u.Message, &info)
 	case *tg.UpdateBotCallbackQuery:
+		info.key = fmt.Sprintf("query:%d", u.QueryID)
 		info.userID = u.UserID
 		info.chatID = getPeerID(u.Peer)
 		info.fromBot = false
@@ -280,21 +330,28 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		info.dataInt = append(info.dataInt, u.ChatInstance)
 		info.dataInt = append(info.dataInt, int64(u.MsgID))
 		info.dataLowCardinality = append(info.dataLowCardinality, u.Peer.TypeName())
+		info.setInt(fieldChatInstance, u.ChatInstance)
+		info.setInt(fieldMessageID, int64(u.MsgID))
+		info.setString(fieldPeerType, u.Peer.TypeName())
 		gameName, okGameName := u.GetGameShortName()
 		if okGameName {
 			info.dataLowCardinality = append(info.dataLowCardinality, gameName)
+			info.setString(fieldGameName, gameName)
 		}
 		return &info
 	case *tg.UpdateEditMessage:
 		return dataFromMessage(u.Message, &info)
 	case *tg.UpdateInlineBotCallbackQuery:
+		info.key = fmt.Sprintf("query:%d", u.QueryID)
 		info.userID = u.UserID
 		info.fromBot = false
 		info.updateSession = true
 		info.dataInt = append(info.dataInt, u.ChatInstance)
+		info.setInt(fieldChatInstance, u.ChatInstance)
 		gameName, okGameName := u.GetGameShortName()
 		if okGameName {
 			info.dataLowCardinality = append(info.dataLowCardinality, gameName)
+			info.setString(fieldGameName, gameName)
 		}
 		return &info
 	case *tg.UpdateReadChannelOutbox: // not needed
@@ -345,6 +402,7 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 	case *tg.UpdateGroupCall:
 	case *tg.UpdatePeerHistoryTTL:
 	case *tg.UpdateChatParticipant:
+		info.key = fmt.Sprintf("qts:%d", u.Qts)
 		info.fromBot = (u.UserID == u.ActorID)
 		info.updateSession = false
 		info.chatID = u.ChatID
@@ -353,15 +411,19 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		info.dataFlags = append(info.dataFlags, okOld)
 		_, okNew := u.GetNewParticipant()
 		info.dataFlags = append(info.dataFlags, okNew)
+		info.setBool(fieldWasMember, okOld)
+		info.setBool(fieldIsMember, okNew)
 		invite, okInvite := u.GetInvite()
 		if okInvite && invite.TypeID() == tg.ChatInviteExportedTypeID {
 			// fmt.Println(invite.(*tg.ChatInviteExported))
 			invite_hash := strings.Replace(invite.(*tg.ChatInviteExported).Link, "https://t.me/", "", 1)
 			info.dataLowCardinality = append(info.dataLowCardinality, invite_hash)
+			info.setString(fieldInviteHash, invite_hash)
 		}
 		info.timestamp = time.Unix(int64(u.Date), 0)
 		return &info
 	case *tg.UpdateChannelParticipant:
+		info.key = fmt.Sprintf("qts:%d", u.Qts)
 		info.fromBot = (u.UserID == u.ActorID)
 		info.updateSession = false
 		info.chatID = u.ChannelID
@@ -370,21 +432,27 @@ func handle(update tg.UpdateClass) *ExtractedInfo {
 		info.dataFlags = append(info.dataFlags, okOld)
 		_, okNew := u.GetNewParticipant()
 		info.dataFlags = append(info.dataFlags, okNew)
+		info.setBool(fieldWasMember, okOld)
+		info.setBool(fieldIsMember, okNew)
 		info.dataFlags = append(info.dataFlags, u.ViaChatlist)
+		info.setBool(fieldViaChatlist, u.ViaChatlist)
 		invite, okInvite := u.GetInvite()
 		if okInvite && invite.TypeID() == tg.ChatInviteExportedTypeID {
 			// fmt.Println(invite.(*tg.ChatInviteExported))
 			invite_hash := strings.Replace(invite.(*tg.ChatInviteExported).Link, "https://t.me/", "", 1)
 			info.dataLowCardinality = append(info.dataLowCardinality, invite_hash)
+			info.setString(fieldInviteHash, invite_hash)
 		}
 		info.timestamp = time.Unix(int64(u.Date), 0)
 		return &info
 	case *tg.UpdateBotStopped:
+		info.key = fmt.Sprintf("qts:%d", u.Qts)
 		info.fromBot = false
 		info.updateSession = false
 		info.chatID = u.UserID
 		info.userID = u.UserID
 		info.dataFlags = append(info.dataFlags, u.Stopped)
+		info.setBool(fieldStopped, u.Stopped)
 		info.timestamp = time.Unix(int64(u.Date), 0)
 		return &info
 	case *tg.UpdateGroupCallConnection:
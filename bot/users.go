@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"context"
+	"go-stats/database"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+// UserCheckResult counts the probed users by reachability.
+type UserCheckResult struct {
+	Reachable int `json:"reachable"`
+	Blocked   int `json:"blocked"`
+	Unknown   int `json:"unknown"`
+}
+
+// Probed returns the number of probed users.
+func (r UserCheckResult) Probed() int {
+	return r.Reachable + r.Blocked + r.Unknown
+}
+
+// ImportUsers adds the users the bot had before it was connected.
+// Known users are left untouched. The first action of the added users
+// is unknown and left null, so they are not counted as new users.
+// Returns the number of added users.
+func (c *ConnectionPool) ImportUsers(botID int64, userIDs []int64, referer string) (int64, error) {
+	now := time.Now()
+	users := make([]database.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		users = append(users, database.User{
+			BotID:            botID,
+			UserID:           userID,
+			LastActionTime:   now,
+			RefererID:        referer,
+			SessionRefererID: referer,
+		})
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+
+	tx := c.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&users, 1000)
+	if tx.Error != nil {
+		return 0, errors.Wrap(tx.Error, "Failed to import users")
+	}
+	return tx.RowsAffected, nil
+}
+
+// CheckUsers probes whether the bot can write to the users and
+// records the result in their private chats. Users which could not be
+// probed are counted as unknown, the probe stops only when ctx is done.
+func (c *ConnectionPool) CheckUsers(ctx context.Context, botID int64, userIDs []int64) (UserCheckResult, error) {
+	var result UserCheckResult
+	bot, ok := c.get(botID)
+	if !ok {
+		return result, errors.New("Bot not found")
+	}
+	dispatcher := bot.dispatcher
+	api := bot.Client().API()
+
+	for _, userID := range userIDs {
+		canWrite, ban, err := checkUser(ctx, api, userID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			dispatcher.logger.Warn("Failed to check user", zap.Int64("user", userID), zap.Error(err))
+			result.Unknown++
+			continue
+		}
+		switch {
+		case canWrite:
+			result.Reachable++
+		case ban:
+			result.Blocked++
+		default:
+			result.Unknown++
+			continue
+		}
+
+		info := &ExtractedInfo{chatID: userID, userID: userID, chatType: "private", timestamp: time.Now()}
+		if err := dispatcher.updateChat(ctx, info, canWrite, ban); err != nil {
+			dispatcher.logger.Error("Failed to update chat", zap.Int64("user", userID), zap.Error(err))
+		}
+	}
+	return result, nil
+}
+
+// checkUser reports whether the bot can write to the user and whether the
+// user blocked the bot or was deleted. Both are false if the bot does not
+// know the user. FLOOD_WAIT is waited out.
+func checkUser(ctx context.Context, api *tg.Client, userID int64) (canWrite bool, ban bool, err error) {
+	request := &tg.MessagesSetTypingRequest{
+		Peer:   &tg.InputPeerUser{UserID: userID},
+		Action: &tg.SendMessageCancelAction{},
+	}
+	for {
+		_, err := api.MessagesSetTyping(ctx, request)
+		wait, err := tgerr.FloodWait(ctx, err)
+		if wait {
+			continue
+		}
+
+		switch {
+		case err == nil:
+			return true, false, nil
+		case tgerr.Is(err, "USER_IS_BLOCKED", "INPUT_USER_DEACTIVATED", "USER_DEACTIVATED"):
+			return false, true, nil
+		case tgerr.Is(err, "PEER_ID_INVALID", "USER_ID_INVALID"):
+			return false, false, nil
+		default:
+			return false, false, err
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// slowDispatch is the time after which a dispatched update is reported as slow.
+const slowDispatch = 30 * time.Second
+
+// DispatchConfig configures the dispatch workers of a bot.
+type DispatchConfig struct {
+	// Number of updates dispatched in parallel
+	Workers int
+	// Number of updates queued per worker before Handle blocks
+	QueueSize int
+	// Apply updates in pts order and recover gaps, see updates.Config
+	GapRecovery bool
+}
+
+func (c *DispatchConfig) setDefaults() {
+	if c.Workers <= 0 {
+		c.Workers = 8
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 256
+	}
+}
+
+// DispatchConfigFromEnv reads DISPATCH_WORKERS, DISPATCH_QUEUE_SIZE and GAP_RECOVERY.
+// Unset options get defaults.
+func DispatchConfigFromEnv() (cfg DispatchConfig, err error) {
+	if v := os.Getenv("DISPATCH_WORKERS"); v != "" {
+		if cfg.Workers, err = strconv.Atoi(v); err != nil {
+			return cfg, errors.Wrap(err, "DISPATCH_WORKERS")
+		}
+	}
+	if v := os.Getenv("DISPATCH_QUEUE_SIZE"); v != "" {
+		if cfg.QueueSize, err = strconv.Atoi(v); err != nil {
+			return cfg, errors.Wrap(err, "DISPATCH_QUEUE_SIZE")
+		}
+	}
+	if v := os.Getenv("GAP_RECOVERY"); v != "" {
+		if cfg.GapRecovery, err = strconv.ParseBool(v); err != nil {
+			return cfg, errors.Wrap(err, "GAP_RECOVERY")
+		}
+	}
+	return cfg, nil
+}
+
+type dispatchJob struct {
+	ctx    context.Context
+	e      Entities
+	update tg.UpdateClass
+	info   *ExtractedInfo
+}
+
+// dispatchWorker processes the updates of the chats hashed to it in order.
+type dispatchWorker struct {
+	queue chan dispatchJob
+	// Start of the current job in unix nanoseconds, 0 when idle
+	started atomic.Int64
+	// Whether the current job was reported as slow
+	reported atomic.Bool
+}
+
+// workerPool runs the dispatch workers of a dispatcher.
+type workerPool struct {
+	workers []*dispatchWorker
+	quit    chan struct{}
+	once    sync.Once
+}
+
+func newWorkerPool(cfg DispatchConfig) *workerPool {
+	cfg.setDefaults()
+	p := &workerPool{
+		workers: make([]*dispatchWorker, cfg.Workers),
+		quit:    make(chan struct{}),
+	}
+	for i := range p.workers {
+		p.workers[i] = &dispatchWorker{queue: make(chan dispatchJob, cfg.QueueSize)}
+	}
+	return p
+}
+
+// worker returns the worker of the key, updates with the same key are
+// processed by the same worker in order.
+func (p *workerPool) worker(key int64) *dispatchWorker {
+	if key < 0 {
+		key = -key
+	}
+	return p.workers[key%int64(len(p.workers))]
+}
+
+func (p *workerPool) stop() {
+	p.once.Do(func() { close(p.quit) })
+}
+
+// startWorkers starts the workers and the slow dispatch watchdog.
+func (u *UpdateDispatcher) startWorkers() {
+	for _, w := range u.workers.workers {
+		go u.runWorker(w)
+	}
+	go u.watchSlowDispatch()
+}
+
+// stopWorkers stops the workers, updates still queued are dropped.
+func (u *UpdateDispatcher) stopWorkers() {
+	u.workers.stop()
+}
+
+func (u *UpdateDispatcher) enqueue(job dispatchJob) {
+	key := job.info.chatID
+	if key == 0 {
+		key = job.info.userID
+	}
+
+	u.inflight.Add(1)
+	u.metrics.inflight.Add(1)
+	select {
+	case u.workers.worker(key).queue <- job:
+	case <-u.workers.quit:
+		u.inflight.Done()
+		u.metrics.inflight.Add(-1)
+		u.logger.Warn("Dispatcher stopped, update dropped", zap.String("update", job.update.TypeName()))
+	}
+}
+
+func (u *UpdateDispatcher) runWorker(w *dispatchWorker) {
+	for {
+		select {
+		case <-u.workers.quit:
+			return
+		case job := <-w.queue:
+			w.reported.Store(false)
+			w.started.Store(time.Now().UnixNano())
+			if err := u.dispatchSync(job.ctx, job.e, job.update, job.info); err != nil {
+				u.logger.Error("Error dispatching update", zap.Error(err))
+			}
+			w.started.Store(0)
+			u.inflight.Done()
+			u.metrics.inflight.Add(-1)
+		}
+	}
+}
+
+// watchSlowDispatch counts the updates dispatched longer than slowDispatch.
+func (u *UpdateDispatcher) watchSlowDispatch() {
+	ticker := time.NewTicker(slowDispatch / 6)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.workers.quit:
+			return
+		case now := <-ticker.C:
+			for _, w := range u.workers.workers {
+				started := w.started.Load()
+				if started == 0 || now.Sub(time.Unix(0, started)) < slowDispatch {
+					continue
+				}
+				if w.reported.CompareAndSwap(false, true) {
+					u.metrics.timeouts.Add(1)
+					u.logger.Error("UpdateDispatcher.dispatch timeout", zap.Int("queued", len(w.queue)))
+				}
+			}
+		}
+	}
+}
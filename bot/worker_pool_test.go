@@ -0,0 +1,96 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"go-stats/database"
+)
+
+// lockedSink is a testSink safe for the dispatch workers.
+type lockedSink struct {
+	mux sync.Mutex
+	testSink
+}
+
+func (s *lockedSink) Push(event *database.Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.testSink.Push(event)
+}
+
+func TestWorkerPoolChatOrder(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		sink   = &lockedSink{}
+		source = "source"
+		app    = "app"
+	)
+	// Chat updates fail on the db, the events are pushed before that
+	u := NewUpdateDispatcher(1, &source, &app, newFailingDB(t), sink, DispatchConfig{Workers: 4, QueueSize: 2}, zap.NewNop())
+	defer u.stopWorkers()
+
+	// Updates of the chats are interleaved and spread over all workers
+	const chats, perChat = 8, 50
+	for id := 1; id <= perChat; id++ {
+		for chat := int64(1); chat <= chats; chat++ {
+			require.NoError(t, u.dispatch(ctx, Entities{}, &tg.UpdateChannelMessageViews{ChannelID: chat, ID: id, Views: 1}))
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	require.Zero(t, u.wait(waitCtx))
+
+	last := map[int64]int64{}
+	for _, event := range sink.events {
+		id := event.DataInt[0]
+		require.Equal(t, last[event.ChatID]+1, id, "chat %d", event.ChatID)
+		last[event.ChatID] = id
+	}
+	require.Len(t, last, chats)
+	require.Len(t, sink.events, chats*perChat)
+}
+
+func TestWorkerPoolEnqueueAfterStop(t *testing.T) {
+	// The workers are not started, so the queue stays full
+	u := UpdateDispatcher{
+		logger:   zap.NewNop(),
+		metrics:  &dispatchMetrics{},
+		inflight: &sync.WaitGroup{},
+		workers:  newWorkerPool(DispatchConfig{Workers: 1, QueueSize: 1}),
+	}
+	job := func() dispatchJob {
+		return dispatchJob{update: &tg.UpdateChannelTooLong{}, info: &ExtractedInfo{chatID: 1}}
+	}
+	u.enqueue(job())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.enqueue(job())
+	}()
+	select {
+	case <-done:
+		t.Fatal("enqueue didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	u.stopWorkers()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue blocked after stopWorkers")
+	}
+	// The dropped update is not left in flight
+	require.Equal(t, int64(1), u.metrics.inflight.Load())
+
+	// Nor does enqueue block once stopped
+	u.enqueue(job())
+	require.Equal(t, int64(1), u.metrics.inflight.Load())
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/pkg/errors"
+)
+
+const (
+	clickHouseDatabase   = "bots"
+	clickHouseMigrations = clickHouseDatabase + ".migrations"
+)
+
+// ClickHouseMigration is a versioned change of the ClickHouse schema.
+//
+// Migrations are applied in version order and never edited once released;
+// to change the schema append a new migration. Column names must match
+// the Event field names, they are used by the batch inserts.
+type ClickHouseMigration struct {
+	Version    uint32
+	Name       string
+	Statements []string
+}
+
+// ClickHouseMigrations is the ClickHouse schema history.
+var ClickHouseMigrations = []ClickHouseMigration{
+	{
+		Version: 1,
+		Name:    "create events table",
+		Statements: []string{`
+			CREATE TABLE IF NOT EXISTS bots.eventsgo (
+				Source             LowCardinality(String),
+				App                LowCardinality(String),
+				BotID              Int64,
+				EventType          LowCardinality(String),
+				EventSubtype       LowCardinality(String) DEFAULT '',
+				FromBot            Bool DEFAULT false,
+				Data               Array(String),
+				DataLowCardinality Array(LowCardinality(String)),
+				DataInt            Array(Int64),
+				DataFlags          Array(Bool),
+				ChatID             Int64 DEFAULT 0,
+				ChatType           LowCardinality(String) DEFAULT '',
+				UserID             Int64 DEFAULT 0,
+				SessionID          Int16 DEFAULT -1,
+				ContentID          LowCardinality(String) DEFAULT '',
+				Language           LowCardinality(String) DEFAULT '',
+				UserCreatedAt      Nullable(DateTime('UTC')),
+				Referer            String DEFAULT '',
+				SessionReferer     String DEFAULT '',
+				ContentReferer     String DEFAULT '',
+				AbMask             Array(LowCardinality(String)),
+				Timestamp          DateTime('UTC') DEFAULT now()
+			)
+			ENGINE = MergeTree
+			PARTITION BY toYYYYMM(Timestamp)
+			ORDER BY (BotID, Timestamp)`,
+		},
+	},
+	{
+		// The sorting key may only be extended with a column added in the same
+		// ALTER. Retried batches and redelivered updates are still stored
+		// twice, queries counting events count distinct EventID.
+		Version: 2,
+		Name:    "add event id",
+		Statements: []string{`
+			ALTER TABLE bots.eventsgo
+				ADD COLUMN EventID UInt64 DEFAULT 0,
+				MODIFY ORDER BY (BotID, Timestamp, EventID)`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add named event fields",
+		Statements: []string{`
+			ALTER TABLE bots.eventsgo
+				ADD COLUMN IF NOT EXISTS Fields Map(LowCardinality(String), String)`,
+		},
+	},
+}
+
+// MigrateClickHouse creates the events database and applies
+// the migrations which were not applied yet.
+func MigrateClickHouse(ctx context.Context, conn driver.Conn) error {
+	if err := conn.Exec(ctx, "CREATE DATABASE IF NOT EXISTS "+clickHouseDatabase); err != nil {
+		return errors.Wrap(err, "Failed to create database")
+	}
+	if err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS `+clickHouseMigrations+` (
+			Version   UInt32,
+			Name      String,
+			AppliedAt DateTime('UTC')
+		)
+		ENGINE = MergeTree
+		ORDER BY Version`,
+	); err != nil {
+		return errors.Wrap(err, "Failed to create migrations table")
+	}
+
+	var applied []struct {
+		Version uint32
+	}
+	if err := conn.Select(ctx, &applied, "SELECT Version FROM "+clickHouseMigrations); err != nil {
+		return errors.Wrap(err, "Failed to get applied migrations")
+	}
+	done := make(map[uint32]bool, len(applied))
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	for _, m := range ClickHouseMigrations {
+		if done[m.Version] {
+			continue
+		}
+		for _, statement := range m.Statements {
+			if err := conn.Exec(ctx, statement); err != nil {
+				return errors.Wrapf(err, "Failed to apply migration %d (%s)", m.Version, m.Name)
+			}
+		}
+		if err := conn.Exec(
+			ctx,
+			"INSERT INTO "+clickHouseMigrations+" (Version, Name, AppliedAt) VALUES (?, ?, ?)",
+			m.Version, m.Name, time.Now().UTC(),
+		); err != nil {
+			return errors.Wrapf(err, "Failed to record migration %d", m.Version)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package database
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 type Bot struct {
 	ID        int64   `gorm:"primaryKey"`
@@ -8,6 +14,8 @@ type Bot struct {
 	TokenHash *[]byte `gorm:"type:bytea"`
 	App       *string `gorm:"size:64"`
 	LoggedIn  bool    `gorm:"default:false"`
+	// Removed through the API, the bot is not run until it is added again
+	Removed bool `gorm:"default:false"`
 }
 
 func (b *Bot) TableName() string {
@@ -15,10 +23,11 @@ func (b *Bot) TableName() string {
 }
 
 type User struct {
-	ID               int64     `gorm:"primaryKey"`
-	BotID            int64     `gorm:"index:idx_bot_user,unique"`
-	UserID           int64     `gorm:"index:idx_bot_user,unique"`
-	FirstActionTime  time.Time `gorm:"autoCreateTime"`
+	ID     int64 `gorm:"primaryKey"`
+	BotID  int64 `gorm:"index:idx_bot_user,unique"`
+	UserID int64 `gorm:"index:idx_bot_user,unique"`
+	// Null for imported users, their first action is unknown
+	FirstActionTime  *time.Time
 	LastActionTime   time.Time `gorm:"autoCreateTime"`
 	RefererID        string    `gorm:"size:64;default:''"`
 	SessionID        int16     `gorm:"default:0"`
@@ -84,30 +93,131 @@ func (u *TgUser) TableName() string {
 }
 
 type Event struct {
-	Source             string     `gorm:"type:lowcardinality;not null"`
-	App                string     `gorm:"type:lowcardinality;not null"`
-	BotID              int64      `gorm:"not null"`
-	EventType          string     `gorm:"type:lowcardinality;not null"`
-	EventSubtype       string     `gorm:"type:lowcardinality;default:''"`
-	FromBot            bool       `gorm:"default:false"`
-	Data               []string   `gorm:"type:Array(String)"`
-	DataLowCardinality []string   `gorm:"type:Array(LowCardinality(String))"`
-	DataInt            []int64    `gorm:"type:Array(Int64)"`
-	DataFlags          []bool     `gorm:"type:Array(Bool)"`
-	ChatID             int64      `gorm:"default:0"`
-	ChatType           string     `gorm:"type:lowcardinality;default:''"`
-	UserID             int64      `gorm:"default:0"`
-	SessionID          int16      `gorm:"type:Int16;default:-1"`
-	ContentID          string     `gorm:"type:lowcardinality;default:''"`
-	Language           string     `gorm:"type:lowcardinality;default:''"`
-	UserCreatedAt      *time.Time `gorm:"type:DateTime('UTC');null"`
-	Referer            string     `gorm:"default:''"`
-	SessionReferer     string     `gorm:"default:''"`
-	ContentReferer     string     `gorm:"default:''"`
-	AbMask             []string   `gorm:"type:Array(LowCardinality(String))"`
-	Timestamp          time.Time  `gorm:"type:DateTime('UTC');default:now();not null"`
+	EventID            uint64            `gorm:"type:UInt64;default:0"`
+	Source             string            `gorm:"type:lowcardinality;not null"`
+	App                string            `gorm:"type:lowcardinality;not null"`
+	BotID              int64             `gorm:"not null"`
+	EventType          string            `gorm:"type:lowcardinality;not null"`
+	EventSubtype       string            `gorm:"type:lowcardinality;default:''"`
+	FromBot            bool              `gorm:"default:false"`
+	Data               []string          `gorm:"type:Array(String)"`
+	DataLowCardinality []string          `gorm:"type:Array(LowCardinality(String))"`
+	DataInt            []int64           `gorm:"type:Array(Int64)"`
+	DataFlags          []bool            `gorm:"type:Array(Bool)"`
+	Fields             map[string]string `gorm:"type:Map(LowCardinality(String), String)"`
+	ChatID             int64             `gorm:"default:0"`
+	ChatType           string            `gorm:"type:lowcardinality;default:''"`
+	UserID             int64             `gorm:"default:0"`
+	SessionID          int16             `gorm:"type:Int16;default:-1"`
+	ContentID          string            `gorm:"type:lowcardinality;default:''"`
+	Language           string            `gorm:"type:lowcardinality;default:''"`
+	UserCreatedAt      *time.Time        `gorm:"type:DateTime('UTC');null"`
+	Referer            string            `gorm:"default:''"`
+	SessionReferer     string            `gorm:"default:''"`
+	ContentReferer     string            `gorm:"default:''"`
+	AbMask             []string          `gorm:"type:Array(LowCardinality(String))"`
+	Timestamp          time.Time         `gorm:"type:DateTime('UTC');default:now();not null"`
 }
 
 func (e *Event) TableName() string {
 	return "bots.eventsgo"
 }
+
+// FunnelStep matches events by type, subtype and the values of named fields.
+// Empty subtype matches any subtype.
+type FunnelStep struct {
+	EventType    string            `json:"event_type"`
+	EventSubtype string            `json:"event_subtype"`
+	Fields       map[string]string `json:"fields,omitempty"`
+}
+
+// FunnelSteps is stored as a JSON array.
+type FunnelSteps []FunnelStep
+
+func (s FunnelSteps) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *FunnelSteps) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	default:
+		return errors.Errorf("Unsupported funnel steps type %T", src)
+	}
+}
+
+type Funnel struct {
+	ID        int64       `gorm:"primaryKey"`
+	BotID     int64       `gorm:"index"`
+	Name      string      `gorm:"size:64"`
+	Steps     FunnelSteps `gorm:"type:jsonb"`
+	Window    int64       `gorm:"default:86400"`
+	CreatedAt time.Time   `gorm:"autoCreateTime"`
+	Bot       Bot         `gorm:"foreignKey:BotID"`
+}
+
+func (f *Funnel) TableName() string {
+	return "funnels"
+}
+
+// Session is the MTProto session of a bot shared by all instances.
+type Session struct {
+	BotID     int64     `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte    `gorm:"type:bytea"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+func (s *Session) TableName() string {
+	return "sessions"
+}
+
+// Instance is a running go-stats process taking part in sharding.
+type Instance struct {
+	ID          string    `gorm:"primaryKey;size:64"`
+	HeartbeatAt time.Time `gorm:"index"`
+}
+
+func (i *Instance) TableName() string {
+	return "instances"
+}
+
+// BotLease gives the instance the right to run the bot until it expires.
+type BotLease struct {
+	BotID     int64     `gorm:"primaryKey;autoIncrement:false"`
+	Owner     string    `gorm:"size:64;index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (l *BotLease) TableName() string {
+	return "botleases"
+}
+
+// UpdateState is the common update state of a bot.
+type UpdateState struct {
+	BotID     int64     `gorm:"primaryKey;autoIncrement:false"`
+	Pts       int       `gorm:"not null"`
+	Qts       int       `gorm:"not null"`
+	Date      int       `gorm:"not null"`
+	Seq       int       `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+func (s *UpdateState) TableName() string {
+	return "updatestates"
+}
+
+// ChannelState is the update state of a channel the bot is in,
+// pts is null until the bot gets an update of the channel.
+type ChannelState struct {
+	BotID      int64  `gorm:"primaryKey;autoIncrement:false"`
+	ChannelID  int64  `gorm:"primaryKey;autoIncrement:false"`
+	Pts        *int   `gorm:"default:null"`
+	AccessHash *int64 `gorm:"default:null"`
+}
+
+func (s *ChannelState) TableName() string {
+	return "channelstates"
+}
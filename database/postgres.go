@@ -0,0 +1,34 @@
+package database
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// BotsChannel is notified with the bot ID when a bot is added,
+// deleted, removed through the API or logged in or out.
+const BotsChannel = "bots_changed"
+
+// InstallBotsTrigger makes changes of the bots table notify BotsChannel.
+func InstallBotsTrigger(db *gorm.DB) error {
+	statements := []string{`
+		CREATE OR REPLACE FUNCTION notify_bots_changed() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + BotsChannel + `', COALESCE(NEW.id, OLD.id)::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS bots_changed ON bots`,
+		`CREATE TRIGGER bots_changed
+		AFTER INSERT OR DELETE OR UPDATE OF logged_in, removed ON bots
+		FOR EACH ROW EXECUTE FUNCTION notify_bots_changed()`,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return errors.Wrap(err, "Failed to install bots trigger")
+			}
+		}
+		return nil
+	})
+}
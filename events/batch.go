@@ -0,0 +1,117 @@
+package events
+
+import (
+	"go-stats/database"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-faster/errors"
+)
+
+// OverflowPolicy decides what Push does when the queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the caller until the queue has room.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest queued event.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowSpill writes the event straight to the on-disk spool.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+// ParseOverflowPolicy parses the policy name.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(name); p {
+	case OverflowBlock, OverflowDropOldest, OverflowSpill:
+		return p, nil
+	default:
+		return "", errors.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// BatchConfig bounds batches of the ClickHouse sink.
+//
+// A batch is flushed as soon as it reaches MaxRows or MaxBytes,
+// or when its oldest event has waited for MaxLatency.
+type BatchConfig struct {
+	MaxRows    int
+	MaxBytes   int
+	MaxLatency time.Duration
+	QueueSize  int
+	Overflow   OverflowPolicy
+}
+
+func (cfg *BatchConfig) setDefaults() {
+	if cfg.MaxRows <= 0 {
+		cfg.MaxRows = 10000
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 16 << 20
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = time.Second * 5
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1000
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowBlock
+	}
+}
+
+// Stats are the event counters of a sink.
+type Stats struct {
+	// Queued is the number of events accepted by Push.
+	Queued int64 `json:"queued"`
+	// Dropped is the number of events dropped on queue overflow.
+	Dropped int64 `json:"dropped"`
+	// Spilled is the number of events written to disk on queue overflow.
+	Spilled int64 `json:"spilled"`
+	// Flushed is the number of events written to the destination.
+	Flushed int64 `json:"flushed"`
+}
+
+func (s *Stats) add(other Stats) {
+	s.Queued += other.Queued
+	s.Dropped += other.Dropped
+	s.Spilled += other.Spilled
+	s.Flushed += other.Flushed
+}
+
+type counters struct {
+	queued, dropped, spilled, flushed atomic.Int64
+}
+
+func (c *counters) stats() Stats {
+	return Stats{
+		Queued:  c.queued.Load(),
+		Dropped: c.dropped.Load(),
+		Spilled: c.spilled.Load(),
+		Flushed: c.flushed.Load(),
+	}
+}
+
+// eventSize estimates the size of the event row in bytes.
+func eventSize(e *database.Event) int {
+	size := 64 // Fixed width columns.
+	for _, s := range [...]string{
+		e.Source, e.App, e.EventType, e.EventSubtype, e.ChatType, e.ContentID,
+		e.Language, e.Referer, e.SessionReferer, e.ContentReferer,
+	} {
+		size += len(s)
+	}
+	for _, s := range e.Data {
+		size += len(s)
+	}
+	for _, s := range e.DataLowCardinality {
+		size += len(s)
+	}
+	for _, s := range e.AbMask {
+		size += len(s)
+	}
+	for k, v := range e.Fields {
+		size += len(k) + len(v)
+	}
+	return size + len(e.DataInt)*8 + len(e.DataFlags)
+}
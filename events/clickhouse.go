@@ -0,0 +1,302 @@
+package events
+
+import (
+	"context"
+	"go-stats/database"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+var _ Sink = (*ClickHouseSink)(nil)
+
+// ClickHouseSink collects events into batches, persists every batch
+// in the spool and sends spooled batches to ClickHouse, retrying with
+// exponential backoff until the insert is accepted.
+type ClickHouseSink struct {
+	conn    driver.Conn
+	spool   *Spool
+	cfg     BatchConfig
+	query   string
+	log     *zap.Logger
+	clickCh chan *database.Event
+	closeCh chan struct{}
+	closed  chan struct{}
+	stats   counters
+
+	// Spilled events the spool didn't accept yet.
+	spill    []*database.Event
+	spillMux sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewClickHouseSink creates the sink and starts its writer.
+//
+// Segments left in the spool by a previous run are replayed first.
+func NewClickHouseSink(conn driver.Conn, spool *Spool, cfg BatchConfig, log *zap.Logger) *ClickHouseSink {
+	cfg.setDefaults()
+	s := &ClickHouseSink{
+		conn:    conn,
+		spool:   spool,
+		cfg:     cfg,
+		query:   "INSERT INTO " + (&database.Event{}).TableName(),
+		log:     log,
+		clickCh: make(chan *database.Event, cfg.QueueSize),
+		closeCh: make(chan struct{}),
+		closed:  make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.sendLoop()
+	go s.run()
+	return s
+}
+
+// Push implements Sink.
+func (s *ClickHouseSink) Push(event *database.Event) {
+	s.stats.queued.Add(1)
+	// Events pushed after Close are not written
+	select {
+	case <-s.closeCh:
+		s.stats.dropped.Add(1)
+		return
+	default:
+	}
+	switch s.cfg.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.clickCh <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.clickCh:
+				s.stats.dropped.Add(1)
+			default:
+			}
+		}
+	case OverflowSpill:
+		select {
+		case s.clickCh <- event:
+		default:
+			s.spillEvent(event)
+		}
+	default:
+		s.clickCh <- event
+	}
+}
+
+// Stats returns the event counters.
+func (s *ClickHouseSink) Stats() Stats {
+	return s.stats.stats()
+}
+
+// Close implements Sink.
+//
+// The pending batch is spooled and one last attempt to send the spool
+// is made; whatever is still unsent is replayed on the next start.
+func (s *ClickHouseSink) Close() error {
+	close(s.closeCh)
+	<-s.closed
+	return nil
+}
+
+func (s *ClickHouseSink) run() {
+	defer close(s.closed)
+
+	// The timer is armed when the first event of a batch arrives.
+	latency := time.NewTimer(s.cfg.MaxLatency)
+	if !latency.Stop() {
+		<-latency.C
+	}
+	defer latency.Stop()
+
+	var (
+		pending []*database.Event
+		size    int
+	)
+	flush := func() {
+		pending = s.persist(pending)
+		if len(pending) == 0 {
+			size = 0
+		} else {
+			// The spool is not writable, retry later.
+			latency.Reset(s.cfg.MaxLatency)
+		}
+		s.flushSpill()
+	}
+
+	for {
+		select {
+		case event := <-s.clickCh:
+			if len(pending) == 0 {
+				latency.Reset(s.cfg.MaxLatency)
+			}
+			pending = append(pending, event)
+			size += eventSize(event)
+			if len(pending) >= s.cfg.MaxRows || size >= s.cfg.MaxBytes {
+				if !latency.Stop() {
+					<-latency.C
+				}
+				flush()
+			}
+		case <-latency.C:
+			flush()
+		case <-s.closeCh:
+			// Drain events which are already queued.
+			for len(s.clickCh) > 0 {
+				pending = append(pending, <-s.clickCh)
+			}
+			pending = s.persist(pending)
+			s.flushSpill()
+
+			// Stop the retry loop and make one last attempt.
+			close(s.stop)
+			<-s.done
+			s.drain()
+
+			if len(pending) > 0 {
+				s.log.Error("Events lost on shutdown", zap.Int("count", len(pending)))
+			}
+			if err := s.spool.Close(); err != nil {
+				s.log.Error("Error closing spool", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// spillEvent writes the overflowed event to the spool. If the spool
+// is not writable the event is kept for the next attempt.
+func (s *ClickHouseSink) spillEvent(event *database.Event) {
+	s.spillMux.Lock()
+	defer s.spillMux.Unlock()
+
+	s.stats.spilled.Add(1)
+	s.spill = s.persist(append(s.spill, event))
+}
+
+func (s *ClickHouseSink) flushSpill() {
+	s.spillMux.Lock()
+	defer s.spillMux.Unlock()
+
+	s.spill = s.persist(s.spill)
+}
+
+// persist writes the pending events to the spool and wakes up the sender.
+// If the spool is not writable the events are kept for the next attempt.
+func (s *ClickHouseSink) persist(pending []*database.Event) []*database.Event {
+	if len(pending) == 0 {
+		return pending
+	}
+	if _, err := s.spool.Append(pending); err != nil {
+		s.log.Error("Error writing events to spool", zap.Error(err), zap.Int("count", len(pending)))
+		return pending
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *ClickHouseSink) sendLoop() {
+	defer close(s.done)
+
+	delay := minRetryDelay
+	for {
+		sent, err := s.sendOldest()
+		if err != nil {
+			s.log.Error("Error writing events", zap.Error(err), zap.Duration("retry_in", delay))
+			select {
+			case <-time.After(delay):
+			case <-s.stop:
+				return
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		delay = minRetryDelay
+		if sent {
+			continue
+		}
+
+		select {
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// drain sends spooled segments until the spool is empty or an insert fails.
+func (s *ClickHouseSink) drain() {
+	for {
+		sent, err := s.sendOldest()
+		if err != nil {
+			n, _ := s.spool.Len()
+			s.log.Error("Error writing events, segments left in spool", zap.Error(err), zap.Int("segments", n))
+			return
+		}
+		if !sent {
+			return
+		}
+	}
+}
+
+// sendOldest sends the oldest spooled segment and removes it from the spool.
+// It reports false if the spool is empty.
+func (s *ClickHouseSink) sendOldest() (bool, error) {
+	id, events, found, err := s.spool.Oldest()
+	if err != nil || !found {
+		return false, err
+	}
+	n, dropped, err := s.send(events)
+	if err != nil {
+		return false, err
+	}
+	s.stats.flushed.Add(int64(n))
+	s.stats.dropped.Add(int64(dropped))
+	if err := s.spool.Remove(id); err != nil {
+		return false, errors.Wrap(err, "remove segment")
+	}
+	return true, nil
+}
+
+// send inserts the events and returns the number of inserted
+// and dropped rows.
+func (s *ClickHouseSink) send(events []*database.Event) (sent, dropped int, err error) {
+	batch, err := s.conn.PrepareBatch(context.Background(), s.query)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "prepare batch")
+	}
+	for _, event := range events {
+		// A row which cannot be appended will never be accepted, skip it
+		// instead of blocking the whole spool.
+		if err := batch.AppendStruct(event); err != nil {
+			dropped++
+			s.log.Error("Error appending event to batch", zap.Error(err))
+		}
+	}
+	// Dropped rows are counted once the segment is sent, not on every retry
+	if err := batch.Send(); err != nil {
+		return 0, 0, errors.Wrap(err, "send batch")
+	}
+	return batch.Rows(), dropped, nil
+}
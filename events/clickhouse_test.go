@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"go-stats/database"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-faster/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeConn accepts rows with a positive BotID and fails the first
+// failSends inserts.
+type fakeConn struct {
+	driver.Conn
+	failSends int
+}
+
+func (c *fakeConn) PrepareBatch(context.Context, string, ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeBatch{conn: c}, nil
+}
+
+type fakeBatch struct {
+	driver.Batch
+	conn *fakeConn
+	rows int
+}
+
+func (b *fakeBatch) AppendStruct(v any) error {
+	if v.(*database.Event).BotID <= 0 {
+		return errors.New("bad row")
+	}
+	b.rows++
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	if b.conn.failSends > 0 {
+		b.conn.failSends--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (b *fakeBatch) Rows() int { return b.rows }
+
+func newTestSink(t *testing.T, conn driver.Conn) *ClickHouseSink {
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "spool.bbolt"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = spool.Close() })
+
+	// The loops are not started, the test drives the sink directly.
+	return &ClickHouseSink{
+		conn:  conn,
+		spool: spool,
+		cfg:   BatchConfig{MaxRows: 100},
+		log:   zap.NewNop(),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func TestClickHouseSinkRetryDropped(t *testing.T) {
+	s := newTestSink(t, &fakeConn{failSends: 2})
+
+	_, err := s.spool.Append([]*database.Event{{BotID: 1}, {BotID: 0}, {BotID: 2}})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		sent, err := s.sendOldest()
+		require.Error(t, err)
+		require.False(t, sent)
+	}
+	require.Equal(t, Stats{}, s.stats.stats())
+
+	sent, err := s.sendOldest()
+	require.NoError(t, err)
+	require.True(t, sent)
+	require.Equal(t, Stats{Dropped: 1, Flushed: 2}, s.stats.stats())
+
+	n, err := s.spool.Len()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestClickHouseSinkSpill(t *testing.T) {
+	s := newTestSink(t, &fakeConn{})
+
+	// Every overflowed event is written to the spool right away.
+	for i := 1; i <= 3; i++ {
+		s.spillEvent(&database.Event{BotID: int64(i)})
+
+		n, err := s.spool.Len()
+		require.NoError(t, err)
+		require.Equal(t, i, n)
+	}
+	require.Empty(t, s.spill)
+	require.Equal(t, int64(3), s.stats.spilled.Load())
+}
+
+func TestClickHouseSinkMaxBytes(t *testing.T) {
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "spool.bbolt"))
+	require.NoError(t, err)
+	s := NewClickHouseSink(&fakeConn{}, spool, BatchConfig{MaxBytes: 4096, MaxLatency: time.Hour}, zap.NewNop())
+	defer func() { require.NoError(t, s.Close()) }()
+
+	s.Push(&database.Event{BotID: 1})
+	time.Sleep(50 * time.Millisecond)
+	require.Zero(t, s.Stats().Flushed)
+
+	// The fields alone fill the batch
+	fields := map[string]string{}
+	for i := 0; i < 64; i++ {
+		fields[fmt.Sprintf("field_%d", i)] = strings.Repeat("x", 64)
+	}
+	s.Push(&database.Event{BotID: 2, Fields: fields})
+	require.Eventually(t, func() bool {
+		return s.Stats().Flushed == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,105 @@
+package events
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultSinks is used when no sinks are configured.
+const DefaultSinks = "clickhouse"
+
+// Open creates the sink described by spec.
+//
+// Spec is a comma separated list of sinks:
+//
+//	clickhouse   - ClickHouse with the on-disk spool at storage/spool.bbolt
+//	file:<path>  - NDJSON file
+//	stdout       - NDJSON to the standard output
+//
+// If several sinks are listed every event is written to all of them.
+func Open(spec string, click driver.Conn, batch BatchConfig, log *zap.Logger) (sink Sink, err error) {
+	if spec == "" {
+		spec = DefaultSinks
+	}
+
+	var sinks FanOut
+	defer func() {
+		if err != nil {
+			_ = sinks.Close()
+		}
+	}()
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "clickhouse":
+			if click == nil {
+				return nil, errors.New("clickhouse sink requires CLICKHOUSE_DSN")
+			}
+			// Unsent batches from the previous run are replayed
+			spool, err := OpenSpool("storage/spool.bbolt")
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, NewClickHouseSink(click, spool, batch, log.Named("clickhouse")))
+		case strings.HasPrefix(name, "file:"):
+			file, err := NewFileSink(strings.TrimPrefix(name, "file:"), log.Named("file"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, file)
+		case name == "stdout":
+			sinks = append(sinks, NewStdoutSink(log.Named("stdout")))
+		default:
+			return nil, errors.Errorf("unknown event sink %q", name)
+		}
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// BatchConfigFromEnv reads the ClickHouse batching options:
+//
+//	EVENTS_MAX_ROWS, EVENTS_MAX_BYTES - flush a batch when it gets this large
+//	EVENTS_MAX_LATENCY                - flush a batch after this duration (e.g. 5s)
+//	EVENTS_QUEUE_SIZE                 - number of events queued before overflow
+//	EVENTS_OVERFLOW                   - block, drop-oldest or spill
+//
+// Unset options get defaults.
+func BatchConfigFromEnv() (cfg BatchConfig, err error) {
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"EVENTS_MAX_ROWS", &cfg.MaxRows},
+		{"EVENTS_MAX_BYTES", &cfg.MaxBytes},
+		{"EVENTS_QUEUE_SIZE", &cfg.QueueSize},
+	}
+	for _, opt := range ints {
+		if v := os.Getenv(opt.name); v != "" {
+			if *opt.dst, err = strconv.Atoi(v); err != nil {
+				return cfg, errors.Wrap(err, opt.name)
+			}
+		}
+	}
+	if v := os.Getenv("EVENTS_MAX_LATENCY"); v != "" {
+		if cfg.MaxLatency, err = time.ParseDuration(v); err != nil {
+			return cfg, errors.Wrap(err, "EVENTS_MAX_LATENCY")
+		}
+	}
+	if v := os.Getenv("EVENTS_OVERFLOW"); v != "" {
+		if cfg.Overflow, err = ParseOverflowPolicy(v); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,68 @@
+package events
+
+import (
+	"encoding/json"
+	"go-stats/database"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+var _ Sink = (*JSONSink)(nil)
+
+// JSONSink writes events as newline delimited JSON.
+type JSONSink struct {
+	w   io.Writer
+	enc *json.Encoder
+	log *zap.Logger
+	mux sync.Mutex
+}
+
+// NewJSONSink creates a sink writing to w.
+// If w is an io.Closer it is closed with the sink.
+func NewJSONSink(w io.Writer, log *zap.Logger) *JSONSink {
+	return &JSONSink{w: w, enc: json.NewEncoder(w), log: log}
+}
+
+// NewFileSink creates a sink appending to the file at path.
+func NewFileSink(path string, log *zap.Logger) (*JSONSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open events file")
+	}
+	return NewJSONSink(f, log), nil
+}
+
+// NewStdoutSink creates a sink writing to the standard output.
+func NewStdoutSink(log *zap.Logger) *JSONSink {
+	return NewJSONSink(nopCloser{os.Stdout}, log)
+}
+
+// Push implements Sink.
+func (s *JSONSink) Push(event *database.Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.enc.Encode(event); err != nil {
+		s.log.Error("Error writing event", zap.Error(err))
+	}
+}
+
+// Close implements Sink.
+func (s *JSONSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// nopCloser hides Close of the wrapped writer.
+type nopCloser struct {
+	io.Writer
+}
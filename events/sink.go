@@ -0,0 +1,53 @@
+// Package events delivers events produced by bots to their destinations.
+package events
+
+import (
+	"go-stats/database"
+
+	"go.uber.org/multierr"
+)
+
+// Sink is a destination for events.
+type Sink interface {
+	// Push queues the event for writing.
+	Push(event *database.Event)
+	// Close flushes queued events and releases the sink.
+	Close() error
+}
+
+// Counter is implemented by sinks which count their events.
+type Counter interface {
+	Stats() Stats
+}
+
+var _ Sink = FanOut{}
+
+// FanOut pushes every event to all of its sinks.
+type FanOut []Sink
+
+// Push implements Sink.
+func (f FanOut) Push(event *database.Event) {
+	for _, sink := range f {
+		sink.Push(event)
+	}
+}
+
+// Close implements Sink.
+func (f FanOut) Close() error {
+	var err error
+	for _, sink := range f {
+		multierr.AppendInto(&err, sink.Close())
+	}
+	return err
+}
+
+// Stats sums the counters of the sinks which count their events.
+func (f FanOut) Stats() Stats {
+	var stats Stats
+	for _, sink := range f {
+		if c, ok := sink.(Counter); ok {
+			stats.add(c.Stats())
+		}
+	}
+	return stats
+}
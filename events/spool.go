@@ -0,0 +1,99 @@
+package events
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"go-stats/database"
+	"io/fs"
+
+	"github.com/go-faster/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var spoolBucket = []byte("segments")
+
+// Spool is a write-ahead log of event batches.
+//
+// Every batch is persisted as a segment before it is sent to ClickHouse
+// and removed only after the insert has been accepted, so batches
+// survive database outages and process restarts.
+type Spool struct {
+	db *bolt.DB
+}
+
+// OpenSpool opens (or creates) the spool database at the given path.
+func OpenSpool(path string) (*Spool, error) {
+	db, err := bolt.Open(path, fs.ModePerm, bolt.DefaultOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "open spool")
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(spoolBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "create spool bucket")
+	}
+	return &Spool{db: db}, nil
+}
+
+func u642b(v uint64) []byte { b := make([]byte, 8); binary.BigEndian.PutUint64(b, v); return b }
+
+func b2u64(b []byte) uint64 { return binary.BigEndian.Uint64(b) }
+
+// Append persists a new segment and returns its id.
+// Segment ids are increasing, so segments are replayed in write order.
+func (s *Spool) Append(events []*database.Event) (uint64, error) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal segment")
+	}
+
+	var id uint64
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spoolBucket)
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(u642b(id), data)
+	})
+	return id, err
+}
+
+// Oldest returns the oldest unsent segment.
+func (s *Spool) Oldest() (id uint64, events []*database.Event, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(spoolBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		id, found = b2u64(k), true
+		return json.Unmarshal(v, &events)
+	})
+	if err != nil {
+		return 0, nil, false, errors.Wrap(err, "read segment")
+	}
+	return id, events, found, nil
+}
+
+// Remove deletes a segment which was successfully sent.
+func (s *Spool) Remove(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).Delete(u642b(id))
+	})
+}
+
+// Len returns the number of unsent segments.
+func (s *Spool) Len() (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(spoolBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Close closes the spool database.
+func (s *Spool) Close() error {
+	return s.db.Close()
+}
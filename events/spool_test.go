@@ -0,0 +1,50 @@
+package events
+
+import (
+	"go-stats/database"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.bbolt")
+
+	spool, err := OpenSpool(path)
+	require.NoError(t, err)
+
+	_, _, found, err := spool.Oldest()
+	require.NoError(t, err)
+	require.False(t, found)
+
+	first, err := spool.Append([]*database.Event{{BotID: 1}, {BotID: 2}})
+	require.NoError(t, err)
+	second, err := spool.Append([]*database.Event{{BotID: 3}})
+	require.NoError(t, err)
+	require.Less(t, first, second)
+	require.NoError(t, spool.Close())
+
+	// Segments survive reopening and are returned in write order.
+	spool, err = OpenSpool(path)
+	require.NoError(t, err)
+	defer spool.Close()
+
+	n, err := spool.Len()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	id, events, found, err := spool.Oldest()
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, first, id)
+	require.Len(t, events, 2)
+	require.Equal(t, int64(2), events[1].BotID)
+
+	require.NoError(t, spool.Remove(id))
+	id, events, found, err = spool.Oldest()
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, second, id)
+	require.Equal(t, int64(3), events[0].BotID)
+}
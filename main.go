@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go-stats/api"
 	"go-stats/bot"
 	"go-stats/database"
+	"go-stats/events"
+	"go-stats/updates"
 	"io/fs"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -25,50 +27,9 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-func writeEvents(ctx context.Context, conn driver.Conn, clickCh chan *database.Event, close chan int, log *zap.Logger) {
-	query := "INSERT INTO " + (&database.Event{}).TableName()
-	tick := time.Tick(time.Second * 5)
-	batch, err := conn.PrepareBatch(context.Background(), query)
-	if err != nil {
-		log.Error("Error preparing batch", zap.Error(err))
-	}
-
-	for {
-		select {
-		case event := <-clickCh:
-			// Append the event to the batch
-			err := batch.AppendStruct(event)
-			if err != nil {
-				log.Error("Error appending event to batch", zap.Error(err))
-			}
-		case <-tick:
-			// Send the batch and prepare a new one
-			err := batch.Send()
-			if err != nil {
-				log.Error("Error writing events", zap.Error(err))
-			}
-			batch, err = conn.PrepareBatch(context.Background(), query)
-			if err != nil {
-				log.Error("Error preparing batch", zap.Error(err))
-			}
-		case <-close:
-			// Send the batch, close the connection and return
-			err := batch.Send()
-			if err != nil {
-				log.Error("Error writing events", zap.Error(err))
-			}
-			err = conn.Close()
-			if err != nil {
-				log.Error("Error closing clickhouse connection", zap.Error(err))
-			}
-			return
-		}
-	}
-}
-
 func main() {
 	godotenv.Load()
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 	if err := run(ctx); err != nil {
 		panic(err)
@@ -99,10 +60,17 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "Error connecting to db")
 	}
-	err = db.AutoMigrate(&database.Bot{}, &database.User{}, &database.Chat{}, &database.ChatMember{}, &database.TgUser{})
+	err = db.AutoMigrate(
+		&database.Bot{}, &database.User{}, &database.Chat{}, &database.ChatMember{}, &database.TgUser{},
+		&database.Funnel{}, &database.Session{}, &database.Instance{}, &database.BotLease{},
+		&database.UpdateState{}, &database.ChannelState{},
+	)
 	if err != nil {
 		return errors.Wrap(err, "Error migrating db")
 	}
+	if err := database.InstallBotsTrigger(db); err != nil {
+		return errors.Wrap(err, "Error migrating db")
+	}
 	postgresDb, err := db.DB()
 	if err != nil {
 		return errors.Wrap(err, "Error getting postgres db")
@@ -111,22 +79,50 @@ func run(ctx context.Context) error {
 	postgresDb.SetMaxOpenConns(500)
 	defer postgresDb.Close()
 
-	// Open the clickhouse database
-	clickOptions, err := clickhouse.ParseDSN(os.Getenv("CLICKHOUSE_DSN"))
+	// Open the clickhouse database, it is optional if events go elsewhere
+	var clickDb driver.Conn
+	if dsn := os.Getenv("CLICKHOUSE_DSN"); dsn != "" {
+		clickOptions, err := clickhouse.ParseDSN(dsn)
+		if err != nil {
+			return errors.Wrap(err, "Error parsing clickhouse DSN")
+		}
+		clickDb, err = clickhouse.Open(clickOptions)
+		if err != nil {
+			return errors.Wrap(err, "Error connecting to clickhouse")
+		}
+		defer func() {
+			if err := clickDb.Close(); err != nil {
+				log.Error("Error closing clickhouse connection", zap.Error(err))
+			}
+		}()
+		if err := database.MigrateClickHouse(ctx, clickDb); err != nil {
+			return errors.Wrap(err, "Error migrating clickhouse")
+		}
+	}
+
+	// Open the event sinks
+	batchConfig, err := events.BatchConfigFromEnv()
 	if err != nil {
-		return errors.Wrap(err, "Error parsing clickhouse DSN")
+		return errors.Wrap(err, "Error reading events batch config")
 	}
-	clickDb, err := clickhouse.Open(clickOptions)
+	sink, err := events.Open(os.Getenv("EVENT_SINKS"), clickDb, batchConfig, log.Named("events"))
 	if err != nil {
-		return errors.Wrap(err, "Error connecting to clickhouse")
+		return errors.Wrap(err, "Error opening event sinks")
 	}
-	clickCh := make(chan *database.Event, 1000)
-	clickClose := make(chan int)
+	// Closed after the bots are shut down, before the databases
 	defer func() {
-		time.Sleep(time.Second)
-		clickClose <- 1
+		if err := sink.Close(); err != nil {
+			log.Error("Error closing event sinks", zap.Error(err))
+		}
+		if counter, ok := sink.(events.Counter); ok {
+			stats := counter.Stats()
+			log.Warn("Event sinks closed",
+				zap.Int64("flushed", stats.Flushed),
+				zap.Int64("dropped", stats.Dropped),
+				zap.Int64("spilled", stats.Spilled),
+			)
+		}
 	}()
-	go writeEvents(ctx, clickDb, clickCh, clickClose, log)
 
 	// Get the API ID
 	apiID, err := strconv.Atoi(os.Getenv("APP_ID"))
@@ -152,40 +148,137 @@ func run(ctx context.Context) error {
 		return errors.Wrap(err, "state database")
 	}
 	defer stateDb.Close()
+	if err := bot.MigrateBoltState(stateDb, log); err != nil {
+		return errors.Wrap(err, "migrate state database")
+	}
+
+	// Sessions are shared through Postgres when bots are sharded between instances
+	instanceID := os.Getenv("INSTANCE_ID")
+	var sessions bot.SessionStore
+	switch storage := os.Getenv("SESSION_STORAGE"); storage {
+	case "", "bolt":
+		if instanceID != "" {
+			return errors.New("INSTANCE_ID requires SESSION_STORAGE=postgres")
+		}
+		sessions = bot.NewBoltSessions(stateDb)
+	case "postgres":
+		sessions = bot.NewPostgresSessions(db, stateDb)
+	default:
+		return errors.Errorf("unknown SESSION_STORAGE %q", storage)
+	}
+
+	// Update state can be moved to Postgres, it starts from
+	// the server state as the bolt state is not copied. Sharded
+	// bots need it in Postgres to keep it when they move.
+	var (
+		state  updates.StateStorage
+		hasher updates.ChannelAccessHasher
+	)
+	switch storage := os.Getenv("STATE_STORAGE"); storage {
+	case "", "bolt":
+		if instanceID != "" {
+			return errors.New("INSTANCE_ID requires STATE_STORAGE=postgres")
+		}
+		state = bot.NewBoltState(stateDb)
+		hasher = bot.NewBoltAccessHasher(stateDb)
+	case "postgres":
+		state = bot.NewPostgresState(db)
+		hasher = bot.NewPostgresAccessHasher(db)
+	default:
+		return errors.Errorf("unknown STATE_STORAGE %q", storage)
+	}
+
+	// State changes are written every STATE_FLUSH_INTERVAL, the changes
+	// of the last interval are lost on crash; 0 writes every change
+	flushInterval := time.Second
+	if interval := os.Getenv("STATE_FLUSH_INTERVAL"); interval != "" {
+		if flushInterval, err = time.ParseDuration(interval); err != nil {
+			return errors.Wrap(err, "STATE_FLUSH_INTERVAL")
+		}
+	}
+	var buffered *updates.BufferedStorage
+	if flushInterval > 0 {
+		buffered = updates.NewBufferedStorage(state, updates.BufferedStorageConfig{
+			FlushInterval: flushInterval,
+			Logger:        log.Named("state"),
+		})
+		state = buffered
+		go buffered.Run(ctx)
+	}
 
-	// Get the bot IDs
-	botIDs := []int64{}
-	botQuery := &database.Bot{LoggedIn: true}
-	err = db.Model(&botQuery).Where(&botQuery).Pluck("id", &botIDs).Error
+	dispatchConfig, err := bot.DispatchConfigFromEnv()
 	if err != nil {
-		return errors.Wrap(err, "Error getting bot IDs")
+		return errors.Wrap(err, "Error reading dispatch config")
 	}
 
-	// Run each bot in a separate goroutine
 	botConnectionPool := bot.NewConnectionPool(
 		ctx,
-		stateDb,
+		state,
+		hasher,
+		sessions,
 		apiID,
 		apiHash,
 		db,
-		clickCh,
+		sink,
+		dispatchConfig,
 		log,
 	)
 
-	for _, botID := range botIDs {
-		go func(id int64) {
-			if err := botConnectionPool.AddBot(id); err != nil {
-				log.Error(fmt.Sprintf("Error starting bot %d: %v\n", id, err))
+	if instanceID != "" {
+		// Bots are run by the instance holding their lease
+		leaseConfig := bot.LeaseConfig{InstanceID: instanceID}
+		if ttl := os.Getenv("LEASE_TTL"); ttl != "" {
+			if leaseConfig.TTL, err = time.ParseDuration(ttl); err != nil {
+				return errors.Wrap(err, "LEASE_TTL")
 			}
-			if err := botConnectionPool.RunBot(id, false); err != nil {
-				log.Error(fmt.Sprintf("Error running bot %d: %v\n", id, err))
+		}
+		if err := botConnectionPool.ShardByLeases(leaseConfig); err != nil {
+			return err
+		}
+		// Leases are released by the shutdown once the state is saved
+		go func() {
+			if err := botConnectionPool.RunLeases(context.Background()); err != nil {
+				log.Error("Error running leases", zap.Error(err))
 			}
-		}(botID)
-		time.Sleep(time.Millisecond * 3)
+		}()
+	}
+
+	// Start the logged in bots and follow changes of the bots table
+	reconcileConfig := bot.ReconcileConfig{DSN: os.Getenv("POSTGRES_DSN")}
+	if interval := os.Getenv("BOTS_POLL_INTERVAL"); interval != "" {
+		if reconcileConfig.Interval, err = time.ParseDuration(interval); err != nil {
+			return errors.Wrap(err, "BOTS_POLL_INTERVAL")
+		}
+	}
+	go botConnectionPool.Reconcile(ctx, reconcileConfig)
+
+	// Shut the bots down before the sinks are flushed and the databases closed
+	shutdownTimeout := 30 * time.Second
+	if timeout := os.Getenv("SHUTDOWN_TIMEOUT"); timeout != "" {
+		if shutdownTimeout, err = time.ParseDuration(timeout); err != nil {
+			return errors.Wrap(err, "SHUTDOWN_TIMEOUT")
+		}
 	}
+	defer func() {
+		log.Warn("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		report := botConnectionPool.Shutdown(shutdownCtx)
+		log.Warn("Bots shut down",
+			zap.Int("bots", report.Bots),
+			zap.Int64("abandoned_updates", report.AbandonedUpdates),
+			zap.Int("state_errors", report.StateErrors),
+		)
+		// The state of the bots stopped before the shutdown
+		if buffered != nil {
+			if err := buffered.Flush(shutdownCtx); err != nil {
+				log.Error("Error flushing state", zap.Error(err))
+			}
+		}
+	}()
 
 	// Run the API
-	go api.Start(ctx, stateDb, apiID, apiHash, db, clickCh, log, &botConnectionPool)
+	go api.Start(ctx, apiID, apiHash, db, sink, clickDb, log, botConnectionPool)
 
 	// Wait for all bots to finish processing updates
 	<-ctx.Done()
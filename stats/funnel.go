@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"context"
+	"go-stats/database"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-faster/errors"
+)
+
+// MaxFunnelSteps is the limit of windowFunnel conditions.
+const MaxFunnelSteps = 32
+
+// FunnelFilter selects the users who entered the funnel in [From, To).
+type FunnelFilter struct {
+	BotID int64
+	Steps []database.FunnelStep
+	// Time allowed between the first and the last step
+	Window time.Duration
+	From   time.Time
+	To     time.Time
+}
+
+// FunnelStepResult is the number of users who reached the step.
+type FunnelStepResult struct {
+	Step  int    `json:"step"`
+	Users uint64 `json:"users"`
+	// Share of the users of the first step
+	Conversion float64 `json:"conversion"`
+	// Share of the users of the previous step
+	StepConversion float64 `json:"step_conversion"`
+}
+
+// Funnel counts the users who did the steps in order within the window.
+func (q *Querier) Funnel(ctx context.Context, f FunnelFilter) ([]FunnelStepResult, error) {
+	query, args, err := funnelQuery(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var levels []struct {
+		Level uint8
+		Users uint64
+	}
+	if err := q.conn.Select(ctx, &levels, query, args...); err != nil {
+		return nil, errors.Wrap(err, "select")
+	}
+
+	// Users who reached a level passed all the steps before it
+	reached := make([]uint64, len(f.Steps))
+	for _, l := range levels {
+		for i := 0; i < int(l.Level) && i < len(reached); i++ {
+			reached[i] += l.Users
+		}
+	}
+
+	results := make([]FunnelStepResult, len(f.Steps))
+	for i, users := range reached {
+		results[i] = FunnelStepResult{Step: i + 1, Users: users}
+		if reached[0] > 0 {
+			results[i].Conversion = float64(users) / float64(reached[0])
+		}
+		if i == 0 {
+			results[i].StepConversion = results[i].Conversion
+		} else if reached[i-1] > 0 {
+			results[i].StepConversion = float64(users) / float64(reached[i-1])
+		}
+	}
+	return results, nil
+}
+
+// funnelQuery builds the query of the funnel levels and its arguments.
+func funnelQuery(f FunnelFilter) (string, []any, error) {
+	if f.BotID == 0 {
+		return "", nil, errors.New("bot id is required")
+	}
+	if len(f.Steps) == 0 || len(f.Steps) > MaxFunnelSteps {
+		return "", nil, errors.Errorf("funnel must have between 1 and %d steps", MaxFunnelSteps)
+	}
+	if f.Window <= 0 {
+		return "", nil, errors.New("window must be positive")
+	}
+
+	args := []any{int64(f.Window / time.Second)}
+	conds := make([]string, 0, len(f.Steps))
+	for _, step := range f.Steps {
+		cond := []string{"EventType = ?"}
+		args = append(args, step.EventType)
+		if step.EventSubtype != "" {
+			cond = append(cond, "EventSubtype = ?")
+			args = append(args, step.EventSubtype)
+		}
+		// Sorted, so the same funnel gives the same query
+		names := make([]string, 0, len(step.Fields))
+		for name := range step.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cond = append(cond, "Fields[?] = ?")
+			args = append(args, name, step.Fields[name])
+		}
+		conds = append(conds, "("+strings.Join(cond, " AND ")+")")
+	}
+	args = append(args, f.BotID, f.From, f.To)
+
+	query := "SELECT Level, count() AS Users FROM (" +
+		"SELECT UserID, windowFunnel(?)(Timestamp, " + strings.Join(conds, ", ") + ") AS Level" +
+		" FROM " + eventsTable +
+		" WHERE BotID = ? AND UserID != 0 AND Timestamp >= ? AND Timestamp < ?" +
+		" GROUP BY UserID" +
+		") WHERE Level > 0 GROUP BY Level"
+	return query, args, nil
+}
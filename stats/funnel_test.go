@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"go-stats/database"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunnelQuery(t *testing.T) {
+	query, args, err := funnelQuery(FunnelFilter{
+		BotID: 1,
+		Steps: []database.FunnelStep{
+			{EventType: "raw", EventSubtype: "NewMessage"},
+			{EventType: "purchase", Fields: map[string]string{"plan": "pro", "currency": "USD"}},
+		},
+		Window: time.Hour,
+		From:   testFrom,
+		To:     testTo,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "SELECT Level, count() AS Users FROM ("+
+		"SELECT UserID, windowFunnel(?)(Timestamp,"+
+		" (EventType = ? AND EventSubtype = ?),"+
+		" (EventType = ? AND Fields[?] = ? AND Fields[?] = ?)) AS Level"+
+		" FROM bots.eventsgo"+
+		" WHERE BotID = ? AND UserID != 0 AND Timestamp >= ? AND Timestamp < ?"+
+		" GROUP BY UserID"+
+		") WHERE Level > 0 GROUP BY Level", query)
+	require.Equal(t, []any{
+		int64(3600),
+		"raw", "NewMessage",
+		"purchase", "currency", "USD", "plan", "pro",
+		int64(1), testFrom, testTo,
+	}, args)
+}
+
+func TestFunnelQueryErrors(t *testing.T) {
+	step := database.FunnelStep{EventType: "raw"}
+	for name, f := range map[string]FunnelFilter{
+		"no bot":    {Steps: []database.FunnelStep{step}, Window: time.Hour},
+		"no steps":  {BotID: 1, Window: time.Hour},
+		"too long":  {BotID: 1, Steps: make([]database.FunnelStep, MaxFunnelSteps+1), Window: time.Hour},
+		"no window": {BotID: 1, Steps: []database.FunnelStep{step}},
+	} {
+		_, _, err := funnelQuery(f)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,102 @@
+package stats
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-faster/errors"
+)
+
+// MaxPeriods limits the width of the cohort matrix.
+const MaxPeriods = 365
+
+// RetentionFilter selects the cohorts of a bot.
+type RetentionFilter struct {
+	BotID int64
+	// Cohorts are users whose first action is in [From, To)
+	From   time.Time
+	To     time.Time
+	Period Period
+	// Number of periods after the first action, including the first one
+	Periods int
+	// Split cohorts by the referer the users came with
+	ByReferer bool
+}
+
+// Cohort is a row of the retention matrix.
+type Cohort struct {
+	Start time.Time `json:"start"`
+	Group string    `json:"group,omitempty"`
+	Size  uint64    `json:"size"`
+	// Active users of the cohort in each period since its start
+	Retained []uint64 `json:"retained"`
+}
+
+// Retention groups the users of the bot into cohorts by the period
+// of their first action and counts the users active in every following period.
+func (q *Querier) Retention(ctx context.Context, f RetentionFilter) ([]Cohort, error) {
+	query, args, err := retentionQuery(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var cells []struct {
+		Start  time.Time
+		Group  string
+		Offset int64
+		Users  uint64
+	}
+	if err := q.conn.Select(ctx, &cells, query, args...); err != nil {
+		return nil, errors.Wrap(err, "select")
+	}
+
+	cohorts := make([]Cohort, 0)
+	for _, c := range cells {
+		if n := len(cohorts); n == 0 || !cohorts[n-1].Start.Equal(c.Start) || cohorts[n-1].Group != c.Group {
+			cohorts = append(cohorts, Cohort{
+				Start:    c.Start,
+				Group:    c.Group,
+				Retained: make([]uint64, f.Periods),
+			})
+		}
+		cohort := &cohorts[len(cohorts)-1]
+		cohort.Retained[c.Offset] = c.Users
+		if c.Offset == 0 {
+			cohort.Size = c.Users
+		}
+	}
+	return cohorts, nil
+}
+
+// retentionQuery builds the query of the cohort cells and its arguments.
+func retentionQuery(f RetentionFilter) (string, []any, error) {
+	if f.BotID == 0 {
+		return "", nil, errors.New("bot id is required")
+	}
+	if f.Periods <= 0 || f.Periods > MaxPeriods {
+		return "", nil, errors.Errorf("periods must be between 1 and %d", MaxPeriods)
+	}
+
+	var start, offset string
+	switch f.Period {
+	case Day, "":
+		start = "toDate(assumeNotNull(UserCreatedAt))"
+		offset = "dateDiff('day', Start, toDate(Timestamp))"
+	case Week:
+		start = "toMonday(assumeNotNull(UserCreatedAt))"
+		offset = "intDiv(dateDiff('day', Start, toMonday(Timestamp)), 7)"
+	default:
+		return "", nil, errors.Errorf("unsupported cohort period %q", f.Period)
+	}
+	group := "''"
+	if f.ByReferer {
+		group = "Referer"
+	}
+
+	query := "SELECT " + start + " AS Start, " + group + " AS `Group`, toInt64(" + offset + ") AS Offset, uniqExact(UserID) AS Users" +
+		" FROM " + eventsTable +
+		" WHERE BotID = ? AND UserID != 0 AND FromBot = false AND UserCreatedAt IS NOT NULL" +
+		" AND UserCreatedAt >= ? AND UserCreatedAt < ? AND Offset >= 0 AND Offset < ?" +
+		" GROUP BY Start, `Group`, Offset ORDER BY Start, `Group`, Offset"
+	return query, []any{f.BotID, f.From, f.To, f.Periods}, nil
+}
@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter RetentionFilter
+		query  string
+	}{
+		{
+			name:   "days",
+			filter: RetentionFilter{BotID: 1, From: testFrom, To: testTo, Periods: 7},
+			query: "SELECT toDate(assumeNotNull(UserCreatedAt)) AS Start, '' AS `Group`," +
+				" toInt64(dateDiff('day', Start, toDate(Timestamp))) AS Offset, uniqExact(UserID) AS Users" +
+				" FROM bots.eventsgo" +
+				" WHERE BotID = ? AND UserID != 0 AND FromBot = false AND UserCreatedAt IS NOT NULL" +
+				" AND UserCreatedAt >= ? AND UserCreatedAt < ? AND Offset >= 0 AND Offset < ?" +
+				" GROUP BY Start, `Group`, Offset ORDER BY Start, `Group`, Offset",
+		},
+		{
+			name:   "weeks by referer",
+			filter: RetentionFilter{BotID: 1, From: testFrom, To: testTo, Period: Week, Periods: 7, ByReferer: true},
+			query: "SELECT toMonday(assumeNotNull(UserCreatedAt)) AS Start, Referer AS `Group`," +
+				" toInt64(intDiv(dateDiff('day', Start, toMonday(Timestamp)), 7)) AS Offset, uniqExact(UserID) AS Users" +
+				" FROM bots.eventsgo" +
+				" WHERE BotID = ? AND UserID != 0 AND FromBot = false AND UserCreatedAt IS NOT NULL" +
+				" AND UserCreatedAt >= ? AND UserCreatedAt < ? AND Offset >= 0 AND Offset < ?" +
+				" GROUP BY Start, `Group`, Offset ORDER BY Start, `Group`, Offset",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := retentionQuery(tt.filter)
+			require.NoError(t, err)
+			require.Equal(t, tt.query, query)
+			require.Equal(t, []any{int64(1), testFrom, testTo, 7}, args)
+		})
+	}
+}
+
+func TestRetentionQueryErrors(t *testing.T) {
+	for name, f := range map[string]RetentionFilter{
+		"no bot":         {Periods: 7},
+		"no periods":     {BotID: 1},
+		"too wide":       {BotID: 1, Periods: MaxPeriods + 1},
+		"monthly period": {BotID: 1, Periods: 7, Period: Month},
+	} {
+		_, _, err := retentionQuery(f)
+		require.Error(t, err, name)
+	}
+}
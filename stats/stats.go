@@ -0,0 +1,175 @@
+// Package stats computes bot statistics from the events stored in ClickHouse.
+package stats
+
+import (
+	"context"
+	"go-stats/database"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-faster/errors"
+)
+
+var eventsTable = (&database.Event{}).TableName()
+
+// Period is the granularity of a time series.
+type Period string
+
+const (
+	Day   Period = "day"
+	Week  Period = "week"
+	Month Period = "month"
+)
+
+// Breakdown is the dimension rows are split by.
+type Breakdown string
+
+const (
+	NoBreakdown Breakdown = ""
+	ByReferer   Breakdown = "referer"
+	ByLanguage  Breakdown = "language"
+	ByChatType  Breakdown = "chat_type"
+)
+
+// Filter selects the events of a bot or an app over a date range.
+type Filter struct {
+	BotID     int64
+	App       string
+	From      time.Time
+	To        time.Time
+	Period    Period
+	Breakdown Breakdown
+}
+
+// Row is a value of a time series.
+type Row struct {
+	Period time.Time `json:"period"`
+	Type   string    `json:"type,omitempty"`
+	Group  string    `json:"group,omitempty"`
+	Value  uint64    `json:"value"`
+}
+
+// Querier runs statistics queries against the events table.
+type Querier struct {
+	conn driver.Conn
+}
+
+func NewQuerier(conn driver.Conn) *Querier {
+	return &Querier{conn: conn}
+}
+
+// metric is an aggregate over the events table.
+type metric struct {
+	value string
+	// Time column the rows are bucketed by
+	time  string
+	where string
+	// Expression splitting the rows by type
+	typ string
+}
+
+var (
+	activeUsers = metric{value: "uniqExact(UserID)", time: "Timestamp", where: "UserID != 0 AND FromBot = false"}
+	newUsers    = metric{value: "uniqExact(UserID)", time: "assumeNotNull(UserCreatedAt)", where: "UserID != 0 AND UserCreatedAt IS NOT NULL"}
+	sessions    = metric{value: "uniqExact(UserID, SessionID)", time: "Timestamp", where: "UserID != 0 AND SessionID > 0"}
+	// Retried batches and redelivered updates are stored with the same
+	// EventID. Events written before EventID was added have it zero.
+	eventCounts = metric{value: "countIf(EventID = 0) + uniqExactIf(EventID, EventID != 0)", time: "Timestamp", where: "1", typ: "concat(EventType, '/', EventSubtype)"}
+)
+
+// ActiveUsers counts the distinct users who did something in the bot.
+func (q *Querier) ActiveUsers(ctx context.Context, f Filter) ([]Row, error) {
+	return q.series(ctx, f, activeUsers)
+}
+
+// NewUsers counts the users by the time of their first action.
+func (q *Querier) NewUsers(ctx context.Context, f Filter) ([]Row, error) {
+	return q.series(ctx, f, newUsers)
+}
+
+// Sessions counts the distinct user sessions.
+func (q *Querier) Sessions(ctx context.Context, f Filter) ([]Row, error) {
+	return q.series(ctx, f, sessions)
+}
+
+// Events counts the events by type and subtype.
+func (q *Querier) Events(ctx context.Context, f Filter) ([]Row, error) {
+	return q.series(ctx, f, eventCounts)
+}
+
+func (q *Querier) series(ctx context.Context, f Filter, m metric) ([]Row, error) {
+	query, args, err := seriesQuery(f, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	if err := q.conn.Select(ctx, &rows, query, args...); err != nil {
+		return nil, errors.Wrap(err, "select")
+	}
+	return rows, nil
+}
+
+// seriesQuery builds the query of the metric and its arguments.
+func seriesQuery(f Filter, m metric) (string, []any, error) {
+	period, err := periodExpr(f.Period, m.time)
+	if err != nil {
+		return "", nil, err
+	}
+	group, err := breakdownExpr(f.Breakdown)
+	if err != nil {
+		return "", nil, err
+	}
+	typ := m.typ
+	if typ == "" {
+		typ = "''"
+	}
+
+	conds := []string{m.where, m.time + " >= ?", m.time + " < ?"}
+	args := []any{f.From, f.To}
+	switch {
+	case f.BotID != 0:
+		conds = append(conds, "BotID = ?")
+		args = append(args, f.BotID)
+	case f.App != "":
+		conds = append(conds, "App = ?")
+		args = append(args, f.App)
+	default:
+		return "", nil, errors.New("bot id or app is required")
+	}
+
+	query := "SELECT " + period + " AS Period, " + typ + " AS Type, " + group + " AS `Group`, " + m.value + " AS Value" +
+		" FROM " + eventsTable +
+		" WHERE " + strings.Join(conds, " AND ") +
+		" GROUP BY Period, Type, `Group` ORDER BY Period, Type, `Group`"
+	return query, args, nil
+}
+
+func periodExpr(p Period, column string) (string, error) {
+	switch p {
+	case Day, "":
+		return "toDate(" + column + ")", nil
+	case Week:
+		return "toMonday(" + column + ")", nil
+	case Month:
+		return "toStartOfMonth(" + column + ")", nil
+	default:
+		return "", errors.Errorf("unknown period %q", p)
+	}
+}
+
+func breakdownExpr(b Breakdown) (string, error) {
+	switch b {
+	case NoBreakdown:
+		return "''", nil
+	case ByReferer:
+		return "Referer", nil
+	case ByLanguage:
+		return "toString(Language)", nil
+	case ByChatType:
+		return "toString(ChatType)", nil
+	default:
+		return "", errors.Errorf("unknown breakdown %q", b)
+	}
+}
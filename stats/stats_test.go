@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testFrom = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testTo   = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func TestSeriesQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter Filter
+		metric metric
+		query  string
+		args   []any
+	}{
+		{
+			name:   "active users",
+			filter: Filter{BotID: 1, From: testFrom, To: testTo},
+			metric: activeUsers,
+			query: "SELECT toDate(Timestamp) AS Period, '' AS Type, '' AS `Group`, uniqExact(UserID) AS Value" +
+				" FROM bots.eventsgo" +
+				" WHERE UserID != 0 AND FromBot = false AND Timestamp >= ? AND Timestamp < ? AND BotID = ?" +
+				" GROUP BY Period, Type, `Group` ORDER BY Period, Type, `Group`",
+			args: []any{testFrom, testTo, int64(1)},
+		},
+		{
+			name:   "new users by referer",
+			filter: Filter{BotID: 1, From: testFrom, To: testTo, Period: Week, Breakdown: ByReferer},
+			metric: newUsers,
+			query: "SELECT toMonday(assumeNotNull(UserCreatedAt)) AS Period, '' AS Type, Referer AS `Group`, uniqExact(UserID) AS Value" +
+				" FROM bots.eventsgo" +
+				" WHERE UserID != 0 AND UserCreatedAt IS NOT NULL" +
+				" AND assumeNotNull(UserCreatedAt) >= ? AND assumeNotNull(UserCreatedAt) < ? AND BotID = ?" +
+				" GROUP BY Period, Type, `Group` ORDER BY Period, Type, `Group`",
+			args: []any{testFrom, testTo, int64(1)},
+		},
+		{
+			name:   "sessions of an app by language",
+			filter: Filter{App: "app", From: testFrom, To: testTo, Period: Month, Breakdown: ByLanguage},
+			metric: sessions,
+			query: "SELECT toStartOfMonth(Timestamp) AS Period, '' AS Type, toString(Language) AS `Group`, uniqExact(UserID, SessionID) AS Value" +
+				" FROM bots.eventsgo" +
+				" WHERE UserID != 0 AND SessionID > 0 AND Timestamp >= ? AND Timestamp < ? AND App = ?" +
+				" GROUP BY Period, Type, `Group` ORDER BY Period, Type, `Group`",
+			args: []any{testFrom, testTo, "app"},
+		},
+		{
+			name:   "events by chat type",
+			filter: Filter{BotID: 1, App: "app", From: testFrom, To: testTo, Period: Day, Breakdown: ByChatType},
+			metric: eventCounts,
+			query: "SELECT toDate(Timestamp) AS Period, concat(EventType, '/', EventSubtype) AS Type, toString(ChatType) AS `Group`," +
+				" countIf(EventID = 0) + uniqExactIf(EventID, EventID != 0) AS Value" +
+				" FROM bots.eventsgo" +
+				" WHERE 1 AND Timestamp >= ? AND Timestamp < ? AND BotID = ?" +
+				" GROUP BY Period, Type, `Group` ORDER BY Period, Type, `Group`",
+			args: []any{testFrom, testTo, int64(1)},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := seriesQuery(tt.filter, tt.metric)
+			require.NoError(t, err)
+			require.Equal(t, tt.query, query)
+			require.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestSeriesQueryCombinations(t *testing.T) {
+	periods := map[Period]string{
+		"":    "toDate(Timestamp) AS Period",
+		Day:   "toDate(Timestamp) AS Period",
+		Week:  "toMonday(Timestamp) AS Period",
+		Month: "toStartOfMonth(Timestamp) AS Period",
+	}
+	breakdowns := map[Breakdown]string{
+		NoBreakdown: "'' AS `Group`",
+		ByReferer:   "Referer AS `Group`",
+		ByLanguage:  "toString(Language) AS `Group`",
+		ByChatType:  "toString(ChatType) AS `Group`",
+	}
+	for _, m := range []metric{activeUsers, sessions, eventCounts} {
+		for period, periodSQL := range periods {
+			for breakdown, groupSQL := range breakdowns {
+				query, args, err := seriesQuery(Filter{BotID: 1, From: testFrom, To: testTo, Period: period, Breakdown: breakdown}, m)
+				require.NoError(t, err)
+				require.Contains(t, query, "SELECT "+periodSQL+", ")
+				require.Contains(t, query, ", "+groupSQL+", "+m.value+" AS Value FROM ")
+				require.Contains(t, query, " GROUP BY Period, Type, `Group` ")
+				require.Equal(t, []any{testFrom, testTo, int64(1)}, args)
+			}
+		}
+	}
+}
+
+func TestSeriesQueryErrors(t *testing.T) {
+	for name, f := range map[string]Filter{
+		"no bot or app":     {From: testFrom, To: testTo},
+		"unknown period":    {BotID: 1, Period: "year"},
+		"unknown breakdown": {BotID: 1, Breakdown: "country"},
+	} {
+		_, _, err := seriesQuery(f, activeUsers)
+		require.Error(t, err, name)
+	}
+}
@@ -11,6 +11,7 @@ func (s *internalState) saveChannelHashes(ctx context.Context, chats []tg.ChatCl
 	ctx, span := s.tracer.Start(ctx, "updates.saveChannelHashes")
 	defer span.End()
 
+	hashes := make(map[int64]int64)
 	for _, c := range chats {
 		switch c := c.(type) {
 		case *tg.Channel:
@@ -26,9 +27,7 @@ func (s *internalState) saveChannelHashes(ctx context.Context, chats []tg.ChatCl
 					zap.Int64("channel_id", c.ID),
 					zap.String("title", c.Title),
 				)
-				if err := s.hasher.SetChannelAccessHash(ctx, s.selfID, c.ID, hash); err != nil {
-					s.log.Error("SetChannelState error", zap.Error(err))
-				}
+				hashes[c.ID] = hash
 			}
 		case *tg.ChannelForbidden:
 			if _, ok := s.channels[c.ID]; ok {
@@ -38,9 +37,22 @@ func (s *internalState) saveChannelHashes(ctx context.Context, chats []tg.ChatCl
 				zap.Int64("channel_id", c.ID),
 				zap.String("title", c.Title),
 			)
-			if err := s.hasher.SetChannelAccessHash(ctx, s.selfID, c.ID, c.AccessHash); err != nil {
-				s.log.Error("SetChannelState error", zap.Error(err))
-			}
+			hashes[c.ID] = c.AccessHash
+		}
+	}
+	if len(hashes) == 0 {
+		return
+	}
+
+	if b, ok := s.hasher.(ChannelAccessHashBatcher); ok {
+		if err := b.SetChannelAccessHashes(ctx, s.selfID, hashes); err != nil {
+			s.log.Error("SetChannelAccessHashes error", zap.Error(err))
+		}
+		return
+	}
+	for channelID, hash := range hashes {
+		if err := s.hasher.SetChannelAccessHash(ctx, s.selfID, channelID, hash); err != nil {
+			s.log.Error("SetChannelState error", zap.Error(err))
 		}
 	}
 }
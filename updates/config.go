@@ -2,6 +2,7 @@ package updates
 
 import (
 	"context"
+	"time"
 
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
@@ -22,9 +23,16 @@ type API interface {
 type Config struct {
 	// Handler where updates will be passed.
 	Handler telegram.UpdateHandler
-	// Callback called if manager cannot
-	// recover channel gap (optional).
-	OnChannelTooLong func(channelID int64)
+	// GapRecovery enables ordered, gap-checked processing:
+	// updates are applied in pts/qts/seq order and gaps are
+	// recovered with updates.getDifference.
+	//
+	// Otherwise updates are passed to the Handler as-is.
+	GapRecovery bool
+	// Callback called if manager cannot recover channel gap
+	// (optional). The channel state is reset to the server
+	// state before, the updates of the gap are lost.
+	OnChannelTooLong func(ctx context.Context, gap ChannelGap)
 	// State storage.
 	// In-mem used if not provided.
 	Storage StateStorage
@@ -54,8 +62,26 @@ func (cfg *Config) setDefaults() {
 		cfg.Storage = newMemStorage()
 	}
 	if cfg.OnChannelTooLong == nil {
-		cfg.OnChannelTooLong = func(channelID int64) {
-			cfg.Logger.Error("Difference too long", zap.Int64("channel_id", channelID))
+		cfg.OnChannelTooLong = func(ctx context.Context, gap ChannelGap) {
+			cfg.Logger.Error("Difference too long",
+				zap.Int64("channel_id", gap.ChannelID),
+				zap.Int("from_pts", gap.FromPts),
+				zap.Int("to_pts", gap.ToPts),
+			)
 		}
 	}
 }
+
+// ChannelGap describes the channel updates lost
+// on updates.channelDifferenceTooLong.
+type ChannelGap struct {
+	ChannelID int64
+	// Pts of the last applied update and the server pts
+	// the channel state is reset to, updates in between are lost.
+	FromPts int
+	ToPts   int
+	// Time the last update of the channel was applied, zero if
+	// none was applied since the start, and the time the gap was found.
+	From time.Time
+	To   time.Time
+}
@@ -13,7 +13,8 @@
 //     of these operations. We rely on the server here.
 //
 //  3. Manager cannot recover the channel gap if there is a ChannelDifferenceTooLong error.
-//     Restoring the internalState in such situation is not the prerogative of this manager.
+//     The channel internalState is reset to the server one and the lost pts range
+//     is passed to Config.OnChannelTooLong.
 //     See: https://core.telegram.org/constructor/updates.channelDifferenceTooLong
 //
 // TODO: Write implementation details.
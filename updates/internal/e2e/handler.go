@@ -34,6 +34,14 @@ func (h *handler) Handle(ctx context.Context, u tg.UpdatesClass) error {
 	}
 }
 
+// count returns the number of handled messages.
+func (h *handler) count() int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return h.messages.count()
+}
+
 // HandleUpdates handler.
 func (h *handler) handleUpdates(ents *Entities, upds []tg.UpdateClass) error {
 	h.mux.Lock()
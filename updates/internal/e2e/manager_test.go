@@ -6,17 +6,25 @@ import (
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-faster/errors"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 	"golang.org/x/sync/errgroup"
 
-	"github.com/gotd/td/telegram/updates"
 	"github.com/gotd/td/tg"
+
+	"go-stats/updates"
 )
 
 func TestE2E(t *testing.T) {
-	testManager(t, func(s *server, storage updates.StateStorage) chan *tg.Updates {
+	t.Run("User", func(t *testing.T) { testE2E(t, false) })
+	t.Run("Bot", func(t *testing.T) { testE2E(t, true) })
+}
+
+func testE2E(t *testing.T, isBot bool) {
+	testManager(t, isBot, func(s *server, storage updates.StateStorage) chan *tg.Updates {
 		t.Helper()
 
 		c := make(chan *tg.Updates, 10)
@@ -76,7 +84,117 @@ func TestE2E(t *testing.T) {
 	})
 }
 
-func testManager(t *testing.T, f func(s *server, storage updates.StateStorage) chan *tg.Updates) {
+// TestE2ELongChannelGap checks that channel gaps longer than
+// the difference limit are recovered page by page.
+func TestE2ELongChannelGap(t *testing.T) {
+	for _, isBot := range []bool{false, true} {
+		isBot := isBot
+		t.Run(fmt.Sprintf("Bot=%v", isBot), func(t *testing.T) {
+			testManager(t, isBot, func(s *server, storage updates.StateStorage) chan *tg.Updates {
+				t.Helper()
+
+				var (
+					biba     = s.peers.createUser("biba")
+					channels []*tg.PeerChannel
+				)
+				require.NoError(t, storage.ForEachChannels(context.Background(), 123, func(ctx context.Context, channelID int64, pts int) error {
+					channels = append(channels, &tg.PeerChannel{
+						ChannelID: channelID,
+					})
+					return nil
+				}))
+
+				c := make(chan *tg.Updates)
+				go func() {
+					defer close(c)
+					for i := 0; i < 250; i++ {
+						u := s.CreateEvent(func(ev *EventBuilder) {
+							ev.SendMessage(biba, channels[0], fmt.Sprintf("biba-channel-%d", i))
+							if i == 0 {
+								ev.SendMessage(biba, channels[1], "biba-channel")
+							}
+						})
+						// Most updates never reach the client.
+						if i%100 == 99 {
+							c <- u
+						}
+					}
+				}()
+				return c
+			})
+		})
+	}
+}
+
+// TestE2EChannelTooLong checks that the channel is reset to the
+// server state and the lost updates are reported.
+func TestE2EChannelTooLong(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		s       = newServer()
+		storage = newMemStorage()
+		hasher  = newMemAccessHasher()
+		gaps    = make(chan updates.ChannelGap, 1)
+	)
+	s.tooLong = 50
+
+	// None of the messages reach the client
+	var (
+		channel = s.peers.createChannel("channel")
+		biba    = s.peers.createUser("biba")
+	)
+	for i := 0; i < 120; i++ {
+		s.CreateEvent(func(ev *EventBuilder) {
+			ev.SendMessage(biba, channel, fmt.Sprintf("biba-channel-%d", i))
+		})
+	}
+
+	// The common state is up to date, the channel is behind
+	const uid = 123
+	require.NoError(t, storage.SetState(ctx, uid, updates.State{Date: s.date}))
+	require.NoError(t, storage.SetChannelPts(ctx, uid, channel.ChannelID, 0))
+	require.NoError(t, hasher.SetChannelAccessHash(ctx, uid, channel.ChannelID, channel.ChannelID*2))
+
+	e := updates.New(updates.Config{
+		Handler:      newHandler(),
+		GapRecovery:  true,
+		Logger:       zaptest.NewLogger(t).Named("gaps"),
+		Storage:      storage,
+		AccessHasher: hasher,
+		OnChannelTooLong: func(ctx context.Context, gap updates.ChannelGap) {
+			gaps <- gap
+		},
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx, s, uid, updates.AuthOptions{}) }()
+
+	// The channel difference is fetched on start
+	select {
+	case gap := <-gaps:
+		require.Equal(t, channel.ChannelID, gap.ChannelID)
+		require.Equal(t, 0, gap.FromPts)
+		require.Equal(t, 120, gap.ToPts)
+		require.True(t, gap.From.IsZero())
+		require.False(t, gap.To.IsZero())
+	case err := <-done:
+		t.Fatalf("Manager stopped: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Gap is not reported")
+	}
+
+	pts, found, err := storage.GetChannelPts(ctx, uid, channel.ChannelID)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 120, pts)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func testManager(t *testing.T, isBot bool, f func(s *server, storage updates.StateStorage) chan *tg.Updates) {
 	t.Helper()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -106,6 +224,7 @@ func testManager(t *testing.T, f func(s *server, storage updates.StateStorage) c
 
 	e := updates.New(updates.Config{
 		Handler:      h,
+		GapRecovery:  true,
 		Logger:       log.Named("gaps"),
 		Storage:      storage,
 		AccessHasher: hasher,
@@ -115,6 +234,7 @@ func testManager(t *testing.T, f func(s *server, storage updates.StateStorage) c
 	g, ctx := errgroup.WithContext(ctx)
 	ready := make(chan struct{})
 	opts := updates.AuthOptions{
+		IsBot: isBot,
 		OnStart: func(ctx context.Context) {
 			t.Log("OnStart")
 			close(ready)
@@ -175,9 +295,24 @@ func testManager(t *testing.T, f func(s *server, storage updates.StateStorage) c
 
 		t.Log("Handle")
 
-		return e.Handle(ctx, &tg.Updates{
+		if err := e.Handle(ctx, &tg.Updates{
 			Updates: ups,
-		})
+		}); err != nil {
+			return err
+		}
+
+		// Updates are applied asynchronously, wait for the recovery.
+		timeout := time.After(10 * time.Second)
+		for h.count() < s.count() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timeout:
+				return errors.Errorf("recovered %d of %d messages", h.count(), s.count())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return nil
 	})
 
 	t.Log("Waiting for shutdown")
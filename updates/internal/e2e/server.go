@@ -10,11 +10,17 @@ import (
 	"github.com/gotd/td/tg"
 )
 
+// maxDiffLimit is the maximum limit of updates.getChannelDifference,
+// allowed for bots only.
+const maxDiffLimit = 100000
+
 // Server for testing gaps.
 type server struct {
 	date     int
 	peers    *peerDatabase
 	messages *messageDatabase
+	// Channel gaps longer than tooLong can't be recovered, if set.
+	tooLong int
 
 	mux sync.Mutex
 }
@@ -34,6 +40,14 @@ func newServer() *server {
 	}
 }
 
+// count returns the number of sent messages.
+func (s *server) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.messages.count()
+}
+
 // UpdatesGetState returns current remote state.
 func (s *server) UpdatesGetState(ctx context.Context) (*tg.UpdatesState, error) {
 	s.mux.Lock()
@@ -128,7 +142,25 @@ func (s *server) UpdatesGetChannelDifference(
 		prepared    []tg.MessageClass
 	)
 
-	for i := request.Pts + 1; i <= len(channelMsgs); i++ {
+	if request.Limit < 1 || request.Limit > maxDiffLimit {
+		return nil, errors.Errorf("LIMIT_INVALID: %d", request.Limit)
+	}
+
+	if s.tooLong > 0 && len(channelMsgs)-request.Pts > s.tooLong {
+		dialog := &tg.Dialog{Peer: &tg.PeerChannel{ChannelID: channel.ChannelID}}
+		dialog.SetPts(len(channelMsgs))
+		return &tg.UpdatesChannelDifferenceTooLong{
+			Dialog: dialog,
+			Final:  true,
+		}, nil
+	}
+
+	// Like the real server, return at most limit updates per call.
+	to := len(channelMsgs)
+	if to-request.Pts > request.Limit {
+		to = request.Pts + request.Limit
+	}
+	for i := request.Pts + 1; i <= to; i++ {
 		prepared = append(prepared, channelMsgs[i-1])
 		s.fillMessageEnts(channelMsgs[i-1], ents)
 	}
@@ -144,8 +176,8 @@ func (s *server) UpdatesGetChannelDifference(
 		NewMessages: prepared,
 		Users:       ents.AsUsers(),
 		Chats:       ents.AsChats(),
-		Pts:         len(channelMsgs),
-		Final:       true,
+		Pts:         to,
+		Final:       to == len(channelMsgs),
 	}, nil
 }
 
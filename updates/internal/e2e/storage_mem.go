@@ -6,7 +6,7 @@ import (
 
 	"github.com/go-faster/errors"
 
-	"github.com/gotd/td/telegram/updates"
+	"go-stats/updates"
 )
 
 var _ updates.StateStorage = (*memStorage)(nil)
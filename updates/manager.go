@@ -6,6 +6,7 @@ import (
 
 	"github.com/go-faster/errors"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
@@ -49,9 +50,9 @@ func New(cfg Config) *Manager {
 // Handle handles updates.
 //
 // Important:
-// If Run method not called, all updates will be passed
-// to the provided handler as-is without any order verification
-// or short updates transformation.
+// If Run method not called or gap recovery is disabled, all updates
+// will be passed to the provided handler as-is without any order
+// verification or short updates transformation.
 func (m *Manager) Handle(ctx context.Context, u tg.UpdatesClass) error {
 	ctx, span := m.tracer.Start(ctx, "updates.Manager.Handle")
 	defer span.End()
@@ -63,7 +64,7 @@ func (m *Manager) Handle(ctx context.Context, u tg.UpdatesClass) error {
 	state := m.state
 	m.mux.Unlock()
 
-	if true || state == nil {
+	if state == nil {
 		m.lg.Debug("Handle (no internalState)")
 		return m.cfg.Handler.Handle(ctx, u)
 	}
@@ -90,6 +91,14 @@ func (m *Manager) Run(ctx context.Context, api API, userID int64, opt AuthOption
 	lg.Debug("Run")
 	defer lg.Debug("Done")
 
+	if !m.cfg.GapRecovery {
+		if opt.OnStart != nil {
+			opt.OnStart(ctx)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
 	wg, ctx := errgroup.WithContext(ctx)
 
 	if err := func() error {
@@ -197,3 +206,16 @@ func (m *Manager) Reset() {
 	defer m.mux.Unlock()
 	m.state = nil
 }
+
+// Flush persists buffered state and access hashes
+// if their storages buffer writes.
+func (m *Manager) Flush(ctx context.Context) error {
+	var err error
+	if f, ok := m.cfg.Storage.(Flusher); ok {
+		multierr.AppendInto(&err, errors.Wrap(f.Flush(ctx), "flush state"))
+	}
+	if f, ok := m.cfg.AccessHasher.(Flusher); ok {
+		multierr.AppendInto(&err, errors.Wrap(f.Flush(ctx), "flush access hashes"))
+	}
+	return err
+}
@@ -28,9 +28,11 @@ type sequenceConfig struct {
 	Tracer       trace.Tracer
 }
 
+// newIdleTimeout returns the first idle timeout, jittered so that
+// many managers started together do not fetch difference at once.
 func newIdleTimeout(multiply int) time.Duration {
-	mult := time.Duration(multiply)
-	return idleTimeout*mult + time.Duration(rand.Intn(15*60*multiply))*time.Minute
+	timeout := idleTimeout * time.Duration(multiply)
+	return timeout + time.Duration(rand.Int63n(int64(timeout)))
 }
 
 func newSequenceBox(cfg sequenceConfig) *sequenceBox {
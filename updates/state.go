@@ -3,7 +3,6 @@ package updates
 import (
 	"context"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/go-faster/errors"
@@ -40,7 +39,6 @@ type internalState struct {
 	pts, qts, seq *sequenceBox
 	date          int
 	idleTimeout   *time.Timer
-	diffMux       *sync.Mutex
 
 	// Channel states.
 	channels map[int64]*channelState
@@ -49,7 +47,7 @@ type internalState struct {
 	client    API
 	log       *zap.Logger
 	handler   telegram.UpdateHandler
-	onTooLong func(channelID int64)
+	onTooLong func(ctx context.Context, gap ChannelGap)
 	storage   StateStorage
 	hasher    ChannelAccessHasher
 	selfID    int64
@@ -68,7 +66,7 @@ type stateConfig struct {
 	Logger           *zap.Logger
 	Tracer           trace.Tracer
 	Handler          telegram.UpdateHandler
-	OnChannelTooLong func(channelID int64)
+	OnChannelTooLong func(ctx context.Context, gap ChannelGap)
 	Storage          StateStorage
 	Hasher           ChannelAccessHasher
 	SelfID           int64
@@ -83,7 +81,6 @@ func newState(ctx context.Context, cfg stateConfig) *internalState {
 
 		date:        cfg.State.Date,
 		idleTimeout: time.NewTimer(newIdleTimeout(1)),
-		diffMux:     &sync.Mutex{},
 
 		channels: make(map[int64]*channelState),
 
@@ -164,16 +161,16 @@ func (s *internalState) Run(ctx context.Context) error {
 			}
 		case <-s.pts.gapTimeout.C:
 			s.log.Debug("Pts gap timeout")
-			// s.getDifferenceLogger(ctx)
+			s.getDifferenceLogger(ctx)
 		case <-s.qts.gapTimeout.C:
 			s.log.Debug("Qts gap timeout")
-			// s.getDifferenceLogger(ctx)
+			s.getDifferenceLogger(ctx)
 		case <-s.seq.gapTimeout.C:
 			s.log.Debug("Seq gap timeout")
-			// s.getDifferenceLogger(ctx)
+			s.getDifferenceLogger(ctx)
 		case <-s.idleTimeout.C:
 			s.log.Debug("Idle timeout")
-			// s.getDifferenceLogger(ctx)
+			s.getDifferenceLogger(ctx)
 		}
 	}
 }
@@ -347,14 +344,6 @@ func (s *internalState) newChannelState(channelID, accessHash int64, initialPts
 }
 
 func (s *internalState) getDifference(ctx context.Context) error {
-	go s.getDifferenceSync(ctx)
-	return nil
-}
-
-func (s *internalState) getDifferenceSync(ctx context.Context) error {
-	s.diffMux.Lock()
-	defer s.diffMux.Unlock()
-
 	ctx, span := s.tracer.Start(ctx, "getDifference")
 	defer span.End()
 
@@ -2,7 +2,6 @@ package updates
 
 import (
 	"context"
-	"sync"
 	"time"
 
 	"github.com/go-faster/errors"
@@ -29,7 +28,8 @@ type channelState struct {
 	pts         *sequenceBox
 	idleTimeout *time.Timer
 	diffTimeout time.Time
-	diffMux     *sync.Mutex
+	// Time the last update was applied.
+	lastApplied time.Time
 
 	// Immutable fields.
 	channelID  int64
@@ -41,7 +41,7 @@ type channelState struct {
 	log        *zap.Logger
 	tracer     trace.Tracer
 	handler    telegram.UpdateHandler
-	onTooLong  func(channelID int64)
+	onTooLong  func(ctx context.Context, gap ChannelGap)
 }
 
 type channelStateConfig struct {
@@ -54,7 +54,7 @@ type channelStateConfig struct {
 	RawClient        API
 	Storage          StateStorage
 	Handler          telegram.UpdateHandler
-	OnChannelTooLong func(channelID int64)
+	OnChannelTooLong func(ctx context.Context, gap ChannelGap)
 	Logger           *zap.Logger
 	Tracer           trace.Tracer
 }
@@ -65,7 +65,6 @@ func newChannelState(cfg channelStateConfig) *channelState {
 		out:     cfg.Out,
 
 		idleTimeout: time.NewTimer(newIdleTimeout(4)),
-		diffMux:     &sync.Mutex{},
 
 		channelID:  cfg.ChannelID,
 		accessHash: cfg.AccessHash,
@@ -135,8 +134,7 @@ func (s *channelState) handleUpdate(ctx context.Context, u tg.UpdateClass, ents
 	s.resetIdleTimer()
 
 	if long, ok := u.(*tg.UpdateChannelTooLong); ok {
-		go s.handleTooLong(ctx, long)
-		return nil
+		return s.handleTooLong(ctx, long)
 	}
 
 	channelID, pts, ptsCount, ok, err := tg.IsChannelPtsUpdate(u)
@@ -164,19 +162,12 @@ func (s *channelState) handleTooLong(ctx context.Context, long *tg.UpdateChannel
 	ctx, span := s.tracer.Start(ctx, "channelState.handleTooLong")
 	defer span.End()
 
-	remotePts, ok := long.GetPts()
-	if !ok {
+	if _, ok := long.GetPts(); !ok {
 		s.log.Warn("Got UpdateChannelTooLong without pts field")
-		return s.getDifference(ctx)
-	}
-
-	// Note: we still can fetch latest diffLim updates.
-	// Should we do?
-	if remotePts-s.pts.State() > s.diffLim {
-		s.onTooLong(s.channelID)
-		return nil
 	}
 
+	// The difference is fetched in pages of diffLim updates,
+	// the server tells if the gap can not be recovered.
 	return s.getDifference(ctx)
 }
 
@@ -206,19 +197,12 @@ func (s *channelState) applyPts(ctx context.Context, state int, updates []update
 	if err := s.storage.SetChannelPts(ctx, s.selfID, s.channelID, state); err != nil {
 		s.log.Error("SetChannelPts error", zap.Error(err))
 	}
+	s.lastApplied = time.Now()
 
 	return nil
 }
 
 func (s *channelState) getDifference(ctx context.Context) error {
-	go s.getDifferenceSync(ctx)
-	return nil
-}
-
-func (s *channelState) getDifferenceSync(ctx context.Context) error {
-	s.diffMux.Lock()
-	defer s.diffMux.Unlock()
-
 	ctx, span := s.tracer.Start(ctx, "channelState.getDifference")
 	defer span.End()
 	s.pts.gaps.Clear()
@@ -297,6 +281,7 @@ func (s *channelState) getDifferenceSync(ctx context.Context) error {
 		}
 
 		s.pts.SetState(diff.Pts, "updates.channelDifference")
+		s.lastApplied = time.Now()
 		if seconds, ok := diff.GetTimeout(); ok {
 			s.diffTimeout = time.Now().Add(time.Second * time.Duration(seconds))
 		}
@@ -326,16 +311,25 @@ func (s *channelState) getDifferenceSync(ctx context.Context) error {
 
 		remotePts, err := getDialogPts(diff.Dialog)
 		if err != nil {
-			s.log.Warn("UpdatesChannelDifferenceTooLong invalid Dialog", zap.Error(err))
-		} else {
-			if err := s.storage.SetChannelPts(ctx, s.selfID, s.channelID, remotePts); err != nil {
-				s.log.Warn("SetChannelPts error", zap.Error(err))
-			}
+			return errors.Wrap(err, "updates.channelDifferenceTooLong invalid dialog")
+		}
 
-			s.pts.SetState(remotePts, "updates.channelDifferenceTooLong dialog new pts")
+		// Reset the channel to the server state, the updates
+		// in between are reported as a gap.
+		gap := ChannelGap{
+			ChannelID: s.channelID,
+			FromPts:   s.pts.State(),
+			ToPts:     remotePts,
+			From:      s.lastApplied,
+			To:        time.Now(),
+		}
+		if err := s.storage.SetChannelPts(ctx, s.selfID, s.channelID, remotePts); err != nil {
+			s.log.Warn("SetChannelPts error", zap.Error(err))
 		}
+		s.pts.SetState(remotePts, "updates.channelDifferenceTooLong dialog new pts")
+		s.lastApplied = gap.To
 
-		s.onTooLong(s.channelID)
+		s.onTooLong(ctx, gap)
 		return nil
 
 	default:
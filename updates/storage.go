@@ -38,8 +38,19 @@ type StateStorage interface {
 	ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error
 }
 
+// Flusher is implemented by storages which buffer writes.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
 // ChannelAccessHasher stores users channel access hashes.
 type ChannelAccessHasher interface {
 	SetChannelAccessHash(ctx context.Context, userID, channelID, accessHash int64) error
 	GetChannelAccessHash(ctx context.Context, userID, channelID int64) (accessHash int64, found bool, err error)
 }
+
+// ChannelAccessHashBatcher is implemented by access hashers which
+// store the hashes of many channels at once.
+type ChannelAccessHashBatcher interface {
+	SetChannelAccessHashes(ctx context.Context, userID int64, hashes map[int64]int64) error
+}
@@ -0,0 +1,326 @@
+package updates
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-faster/errors"
+	"go.uber.org/zap"
+)
+
+// StateBatch is a set of state changes by user ID.
+type StateBatch struct {
+	States   map[int64]State
+	Channels map[int64]map[int64]int
+}
+
+// BatchStorage is implemented by storages which apply
+// a batch of state changes in a single transaction.
+type BatchStorage interface {
+	SetBatch(ctx context.Context, batch StateBatch) error
+}
+
+// BufferedStorageConfig configures BufferedStorage.
+type BufferedStorageConfig struct {
+	// FlushInterval bounds the time a change is kept only in memory,
+	// 1 second by default.
+	FlushInterval time.Duration
+	// Logger (optional).
+	Logger *zap.Logger
+}
+
+func (cfg *BufferedStorageConfig) setDefaults() {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+}
+
+var (
+	_ StateStorage = (*BufferedStorage)(nil)
+	_ Flusher      = (*BufferedStorage)(nil)
+)
+
+// BufferedStorage keeps the latest state in memory and writes it to
+// the underlying storage on Flush, in a single transaction if the
+// storage implements BatchStorage.
+//
+// Changes made since the last flush are lost on crash, so the stored
+// state may lag behind and updates are fetched again after restart.
+// States are cached until they are flushed, so a state changed in the
+// underlying storage by another instance is read again after a flush.
+type BufferedStorage struct {
+	next StateStorage
+	cfg  BufferedStorageConfig
+
+	mux sync.Mutex
+	// Latest states, a state is written if it is dirty
+	// and dropped once it is written
+	states map[int64]State
+	dirty  map[int64]bool
+	// Channel pts not written yet
+	channels map[int64]map[int64]int
+
+	// Serializes flushes
+	flushMux sync.Mutex
+}
+
+// NewBufferedStorage creates a new BufferedStorage writing to next.
+func NewBufferedStorage(next StateStorage, cfg BufferedStorageConfig) *BufferedStorage {
+	cfg.setDefaults()
+	return &BufferedStorage{
+		next:     next,
+		cfg:      cfg,
+		states:   map[int64]State{},
+		dirty:    map[int64]bool{},
+		channels: map[int64]map[int64]int{},
+	}
+}
+
+// Run flushes the changes every FlushInterval until ctx is done.
+func (s *BufferedStorage) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				s.cfg.Logger.Error("Flush state error", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush writes the changes made since the last flush.
+// Failed changes are kept and written by the next flush.
+func (s *BufferedStorage) Flush(ctx context.Context) error {
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+
+	batch := s.snapshot()
+	if len(batch.States) > 0 || len(batch.Channels) > 0 {
+		if err := s.write(ctx, batch); err != nil {
+			return errors.Wrap(err, "write state")
+		}
+	}
+
+	// Keep the changes made during the write
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for userID, state := range batch.States {
+		if s.states[userID] == state {
+			delete(s.dirty, userID)
+		}
+	}
+	for userID := range s.states {
+		if !s.dirty[userID] {
+			delete(s.states, userID)
+		}
+	}
+	for userID, channels := range batch.Channels {
+		pending := s.channels[userID]
+		for channelID, pts := range channels {
+			if v, ok := pending[channelID]; ok && v == pts {
+				delete(pending, channelID)
+			}
+		}
+		if len(pending) == 0 {
+			delete(s.channels, userID)
+		}
+	}
+	return nil
+}
+
+func (s *BufferedStorage) snapshot() StateBatch {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	batch := StateBatch{
+		States:   make(map[int64]State, len(s.dirty)),
+		Channels: make(map[int64]map[int64]int, len(s.channels)),
+	}
+	for userID := range s.dirty {
+		batch.States[userID] = s.states[userID]
+	}
+	for userID, channels := range s.channels {
+		c := make(map[int64]int, len(channels))
+		for channelID, pts := range channels {
+			c[channelID] = pts
+		}
+		batch.Channels[userID] = c
+	}
+	return batch
+}
+
+func (s *BufferedStorage) write(ctx context.Context, batch StateBatch) error {
+	if b, ok := s.next.(BatchStorage); ok {
+		return b.SetBatch(ctx, batch)
+	}
+
+	for userID, state := range batch.States {
+		if err := s.next.SetState(ctx, userID, state); err != nil {
+			return err
+		}
+	}
+	for userID, channels := range batch.Channels {
+		for channelID, pts := range channels {
+			if err := s.next.SetChannelPts(ctx, userID, channelID, pts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BufferedStorage) GetState(ctx context.Context, userID int64) (State, bool, error) {
+	s.mux.Lock()
+	state, ok := s.states[userID]
+	s.mux.Unlock()
+	if ok {
+		return state, true, nil
+	}
+
+	state, found, err := s.next.GetState(ctx, userID)
+	if err != nil || !found {
+		return state, found, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// The state could be set meanwhile
+	if cached, ok := s.states[userID]; ok {
+		return cached, true, nil
+	}
+	s.states[userID] = state
+	return state, true, nil
+}
+
+func (s *BufferedStorage) SetState(ctx context.Context, userID int64, state State) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.states[userID] = state
+	s.dirty[userID] = true
+	return nil
+}
+
+func (s *BufferedStorage) SetPts(ctx context.Context, userID int64, pts int) error {
+	return s.update(ctx, userID, func(state *State) { state.Pts = pts })
+}
+
+func (s *BufferedStorage) SetQts(ctx context.Context, userID int64, qts int) error {
+	return s.update(ctx, userID, func(state *State) { state.Qts = qts })
+}
+
+func (s *BufferedStorage) SetDate(ctx context.Context, userID int64, date int) error {
+	return s.update(ctx, userID, func(state *State) { state.Date = date })
+}
+
+func (s *BufferedStorage) SetSeq(ctx context.Context, userID int64, seq int) error {
+	return s.update(ctx, userID, func(state *State) { state.Seq = seq })
+}
+
+func (s *BufferedStorage) SetDateSeq(ctx context.Context, userID int64, date, seq int) error {
+	return s.update(ctx, userID, func(state *State) {
+		state.Date = date
+		state.Seq = seq
+	})
+}
+
+// update changes the existing state of the user.
+func (s *BufferedStorage) update(ctx context.Context, userID int64, f func(state *State)) error {
+	state, found, err := s.GetState(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("internalState not found")
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// The loaded state could be changed or flushed meanwhile
+	if cached, ok := s.states[userID]; ok {
+		state = cached
+	}
+	f(&state)
+	s.states[userID] = state
+	s.dirty[userID] = true
+	return nil
+}
+
+func (s *BufferedStorage) GetChannelPts(ctx context.Context, userID, channelID int64) (int, bool, error) {
+	s.mux.Lock()
+	pts, ok := s.channels[userID][channelID]
+	s.mux.Unlock()
+	if ok {
+		return pts, true, nil
+	}
+
+	return s.next.GetChannelPts(ctx, userID, channelID)
+}
+
+func (s *BufferedStorage) SetChannelPts(ctx context.Context, userID, channelID int64, pts int) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	channels, ok := s.channels[userID]
+	if !ok {
+		channels = map[int64]int{}
+		s.channels[userID] = channels
+	}
+	channels[channelID] = pts
+	return nil
+}
+
+func (s *BufferedStorage) ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
+	s.mux.Lock()
+	pending := make(map[int64]int, len(s.channels[userID]))
+	for channelID, pts := range s.channels[userID] {
+		pending[channelID] = pts
+	}
+	s.mux.Unlock()
+
+	if err := s.next.ForEachChannels(ctx, userID, func(ctx context.Context, channelID int64, pts int) error {
+		if v, ok := pending[channelID]; ok {
+			pts = v
+			delete(pending, channelID)
+		}
+		return f(ctx, channelID, pts)
+	}); err != nil {
+		return err
+	}
+
+	for channelID, pts := range pending {
+		if err := f(ctx, channelID, pts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteChannelPts drops the channel pts, the stored pts are deleted
+// if the underlying storage supports it.
+func (s *BufferedStorage) DeleteChannelPts(ctx context.Context, userID, channelID int64) error {
+	// A flush in progress could write the pts back
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+
+	s.mux.Lock()
+	delete(s.channels[userID], channelID)
+	s.mux.Unlock()
+
+	if d, ok := s.next.(interface {
+		DeleteChannelPts(ctx context.Context, userID, channelID int64) error
+	}); ok {
+		return d.DeleteChannelPts(ctx, userID, channelID)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package updates
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedStorage(t *testing.T) {
+	ctx := context.Background()
+	next := newMemStorage()
+	s := NewBufferedStorage(next, BufferedStorageConfig{})
+
+	require.Error(t, s.SetPts(ctx, 1, 10))
+
+	require.NoError(t, s.SetState(ctx, 1, State{Pts: 1, Qts: 2, Date: 3, Seq: 4}))
+	require.NoError(t, s.SetPts(ctx, 1, 10))
+	require.NoError(t, s.SetDateSeq(ctx, 1, 30, 40))
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+
+	// Nothing is written before the flush
+	_, found, err := next.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = next.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, State{Pts: 10, Qts: 2, Date: 30, Seq: 40}, state)
+	pts, found, err := s.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, pts)
+
+	require.NoError(t, s.Flush(ctx))
+	state, found, err = next.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, State{Pts: 10, Qts: 2, Date: 30, Seq: 40}, state)
+	pts, found, err = next.GetChannelPts(ctx, 1, 100)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, pts)
+
+	// Pending pts override the stored ones
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 6))
+	require.NoError(t, s.SetChannelPts(ctx, 1, 200, 7))
+	channels := map[int64]int{}
+	require.NoError(t, s.ForEachChannels(ctx, 1, func(ctx context.Context, channelID int64, pts int) error {
+		channels[channelID] = pts
+		return nil
+	}))
+	require.Equal(t, map[int64]int{100: 6, 200: 7}, channels)
+}
+
+type batchMemStorage struct {
+	*memStorage
+	batches []StateBatch
+}
+
+func (s *batchMemStorage) SetBatch(ctx context.Context, batch StateBatch) error {
+	s.batches = append(s.batches, batch)
+	for userID, state := range batch.States {
+		if err := s.memStorage.SetState(ctx, userID, state); err != nil {
+			return err
+		}
+	}
+	for userID, channels := range batch.Channels {
+		for channelID, pts := range channels {
+			if err := s.memStorage.SetChannelPts(ctx, userID, channelID, pts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestBufferedStorageBatch(t *testing.T) {
+	ctx := context.Background()
+	next := &batchMemStorage{memStorage: newMemStorage()}
+	s := NewBufferedStorage(next, BufferedStorageConfig{})
+
+	require.NoError(t, s.SetState(ctx, 1, State{Pts: 1}))
+	require.NoError(t, s.SetPts(ctx, 1, 2))
+	require.NoError(t, s.SetPts(ctx, 1, 3))
+	require.NoError(t, s.SetState(ctx, 2, State{Pts: 4}))
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 5))
+	require.NoError(t, s.SetChannelPts(ctx, 1, 100, 6))
+
+	// The latest values are written at once
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, []StateBatch{{
+		States:   map[int64]State{1: {Pts: 3}, 2: {Pts: 4}},
+		Channels: map[int64]map[int64]int{1: {100: 6}},
+	}}, next.batches)
+
+	// Flushed changes are not written again
+	require.NoError(t, s.Flush(ctx))
+	require.Len(t, next.batches, 1)
+
+	require.NoError(t, s.SetQts(ctx, 2, 7))
+	require.NoError(t, s.Flush(ctx))
+	require.Equal(t, StateBatch{
+		States:   map[int64]State{2: {Pts: 4, Qts: 7}},
+		Channels: map[int64]map[int64]int{},
+	}, next.batches[1])
+}
+
+func TestBufferedStorageReload(t *testing.T) {
+	ctx := context.Background()
+	next := newMemStorage()
+	s := NewBufferedStorage(next, BufferedStorageConfig{})
+
+	require.NoError(t, s.SetState(ctx, 1, State{Pts: 1}))
+	require.NoError(t, s.Flush(ctx))
+
+	// Another instance moves the state on
+	require.NoError(t, next.SetPts(ctx, 1, 5))
+	state, found, err := s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 5, state.Pts)
+
+	// A cached state is read again after a flush
+	require.NoError(t, next.SetPts(ctx, 1, 6))
+	require.NoError(t, s.Flush(ctx))
+	require.NoError(t, s.SetQts(ctx, 1, 2))
+	state, _, err = s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, State{Pts: 6, Qts: 2}, state)
+
+	// Changes not flushed yet are kept
+	require.NoError(t, next.SetPts(ctx, 1, 7))
+	state, _, err = s.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, State{Pts: 6, Qts: 2}, state)
+	require.NoError(t, s.Flush(ctx))
+	state, _, err = next.GetState(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, State{Pts: 6, Qts: 2}, state)
+}